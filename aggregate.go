@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// with -etld1, decisions are also saved under the registrable domain (eTLD+1, by the bundled public suffix list),
+// and reused for its subdomains not seen before,
+// stored as "*.example.com." so it won't collide with the decision of "example.com." itself
+
+var etld1Hits = newCounter("etld1-hits")
+
+func registrableKey(name string) (string, bool) {
+	if !*etld1 || etld1Exclude.includes(name) {
+		return "", false
+	}
+	d, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimSuffix(name, ".")))
+	if err != nil {
+		return "", false
+	}
+	return "*." + d + ".", true
+}
+
+// get the decision for name from cache, falls back to learned rules, then its registrable domain
+func cacheLookup(p *profile, name string) int {
+	dec := p.cache.get(name)
+	if dec != noDecision {
+		return dec
+	}
+	if dec = p.learn.lookup(name); dec != noDecision {
+		if learnVerifySample() {
+			go learnVerifyName(p, name)
+		}
+		return dec
+	}
+	if k, ok := registrableKey(name); ok {
+		dec = p.cache.get(k)
+		if dec != noDecision {
+			etld1Hits.inc()
+			log.Printf("\tdecision %s: %s, from %s", name, decisionToStr(dec), k)
+		}
+	}
+	return dec
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// ANY queries, RFC 8482, by -any
+//	notimp: NOTIMP, like before
+//	hinfo: a synthesized minimal HINFO RRset
+//	forward: diverged like other types, the answer is filtered like an A answer from that upstream
+
+const (
+	anyNotImp = iota
+	anyHINFO
+	anyForward
+)
+
+var anyMode = anyNotImp
+
+// TTL of the synthesized HINFO
+const anyHINFOTTL = 3600
+
+var anyAnswered = newCounter("any-answered")
+
+func parseAny(s string) {
+	switch s {
+	case "notimp":
+		anyMode = anyNotImp
+	case "hinfo":
+		anyMode = anyHINFO
+	case "forward":
+		anyMode = anyForward
+	default:
+		log.Fatalf("invalid -any: %s", s)
+	}
+}
+
+// true if answered here, false if to be diverged
+func handleANY(w dns.ResponseWriter, req *dns.Msg) bool {
+	switch anyMode {
+	case anyHINFO:
+		anyAnswered.inc()
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.RecursionAvailable = true
+		res.Answer = append(res.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    anyHINFOTTL,
+			},
+			Cpu: "RFC8482",
+		})
+		w.WriteMsg(res)
+		return true
+	case anyForward:
+		return false
+	default:
+		log.Print("\tquery type ANY not supported\n")
+		handleWith(w, req, dns.RcodeNotImplemented)
+		return true
+	}
+}
+
+// A records in the answer of A-side upstream dec are held to its set, like an A answer,
+// those out of set are dropped if the answer wouldn't be taken as an A answer
+func filterANY(p *profile, res *dns.Msg, dec int) {
+	v := dec - upstreamA + ipA
+	if !postChk(p, res, v) {
+		_, res.Answer = filterRR(p, res.Answer, v)
+		_, res.Extra = filterRR(p, res.Extra, v)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"diverge/ip4map"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// shadow comparison, for a sampled fraction of traffic every upstream is queried,
+// cache hit or not, and answers that contradict the IP sets are recorded,
+// to help find holes in the IP lists
+
+const auditReportSize = 64
+
+var (
+	audited       = newCounter("audited")
+	auditFindings = newCounter("audit-findings")
+)
+
+var auditReport = struct {
+	sync.Mutex
+	findings []string
+	next     int
+}{}
+
+func auditSample() bool {
+	return *auditRate > 0 && rand.Float64() < *auditRate
+}
+
+func auditRecord(name, format string, a ...interface{}) {
+	f := name + " " + fmt.Sprintf(format, a...)
+	log.Printf("audit %s", f)
+	auditFindings.inc()
+	auditReport.Lock()
+	defer auditReport.Unlock()
+	if len(auditReport.findings) < auditReportSize {
+		auditReport.findings = append(auditReport.findings, f)
+	} else {
+		auditReport.findings[auditReport.next] = f
+	}
+	auditReport.next = (auditReport.next + 1) % auditReportSize
+}
+
+func auditInfo() []string {
+	auditReport.Lock()
+	defer auditReport.Unlock()
+	r := []string{"audited " + strconv.FormatInt(audited.get(), 10) +
+		", findings " + strconv.FormatInt(auditFindings.get(), 10)}
+	// oldest first
+	if len(auditReport.findings) == auditReportSize {
+		r = append(r, auditReport.findings[auditReport.next:]...)
+		r = append(r, auditReport.findings[:auditReport.next]...)
+	} else {
+		r = append(r, auditReport.findings...)
+	}
+	return r
+}
+
+func answerIPs(m *dns.Msg) []net.IP {
+	ips := []net.IP{}
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A)
+		}
+	}
+	return ips
+}
+
+func ipValueToStr(v int) string {
+	switch v {
+	case ipUnknown:
+		return "no set"
+	case ipPrivate:
+		return "special"
+	default:
+		return decisionToStr(upstreamA+v-ipA) + "'s set"
+	}
+}
+
+// audit name against every upstream, cached is the decision currently in use by profile p
+func auditName(p *profile, name string, cached int) {
+	audited.inc()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	ev := make(evidence, len(upstream))
+	var wg sync.WaitGroup
+	for i := range upstream {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, _, err := exchange(req.Copy(), i+upstreamX)
+			if err != nil {
+				log.Printf("audit %s: upstream %s error: %v", name, decisionToStr(i+upstreamX), err)
+				return
+			}
+			ev.addAnswer(i, res)
+		}(i)
+	}
+	wg.Wait()
+
+	// only upstreams used by this profile
+	audit := map[int]bool{0: true}
+	for _, i := range p.links {
+		audit[i+1] = true
+	}
+	for i, ips := range ev {
+		if !audit[i] {
+			continue
+		}
+		for _, ip := range ips {
+			v := p.ipMap.Get(ip)
+			if (i == 0 && v >= ipA) || (i > 0 && !inSet(p, *ip4map.Uint32ToIP(ip), i-1+ipA)) {
+				auditRecord(name, "%s answered %s which is in %s", names[i], ip4map.Uint32ToIPStr(ip), ipValueToStr(v))
+			}
+		}
+	}
+	decision, ok := ev.classify(p)
+	if !ok || (decision == upstreamX && ev[0] == nil) {
+		return
+	}
+	p.learn.learn(name, decision)
+	if cached != noDecision && decision != cached {
+		auditRecord(name, "decision would change from %s to %s", decisionToStr(cached), decisionToStr(decision))
+	}
+}
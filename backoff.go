@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// short-term negative cache, with -backoff a name whose probe failed,
+// or succeeded with some upstreams failing, is answered by the best known upstream
+// for a while instead of being probed again on every query
+
+type backoffEntry struct {
+	dec    int
+	reason string
+	until  time.Time
+}
+
+var backoffStore = struct {
+	sync.Mutex
+	m map[string]*backoffEntry
+}{m: map[string]*backoffEntry{}}
+
+var (
+	backoffs    = newCounter("backoffs")
+	backoffHits = newCounter("backoff-hits")
+)
+
+// keyed like nsCache, name of default profile as is
+func backoffKey(p *profile, name string) string {
+	if p == defaultProfile {
+		return strings.ToLower(name)
+	}
+	return p.name + "/" + strings.ToLower(name)
+}
+
+// dec is the best known upstream, X if none
+func backoffSave(p *profile, name string, dec int, reasons []string) {
+	if *backoff <= 0 {
+		return
+	}
+	if dec == noDecision {
+		dec = upstreamX
+	}
+	reason := strings.Join(reasons, "; ")
+	log.Printf("\tbackoff %s: %s for %v, %s", name, decisionToStr(dec), *backoff, reason)
+	backoffs.inc()
+	now := time.Now()
+	backoffStore.Lock()
+	defer backoffStore.Unlock()
+	for k, e := range backoffStore.m {
+		if now.After(e.until) {
+			delete(backoffStore.m, k)
+		}
+	}
+	backoffStore.m[backoffKey(p, name)] = &backoffEntry{dec, reason, now.Add(*backoff)}
+}
+
+func backoffLookup(p *profile, name string) int {
+	if *backoff <= 0 {
+		return noDecision
+	}
+	k := backoffKey(p, name)
+	backoffStore.Lock()
+	defer backoffStore.Unlock()
+	e, in := backoffStore.m[k]
+	if !in {
+		return noDecision
+	}
+	if time.Now().After(e.until) {
+		delete(backoffStore.m, k)
+		return noDecision
+	}
+	backoffHits.inc()
+	log.Printf("\tbackoff %s: %s, %s", name, decisionToStr(e.dec), e.reason)
+	return e.dec
+}
+
+func backoffInfo() []string {
+	now := time.Now()
+	backoffStore.Lock()
+	defer backoffStore.Unlock()
+	r := []string{}
+	for k, e := range backoffStore.m {
+		if now.After(e.until) {
+			continue
+		}
+		r = append(r, fmt.Sprintf("%s %s for %v, %s", k, decisionToStr(e.dec), e.until.Sub(now).Round(time.Second), e.reason))
+	}
+	sort.Strings(r)
+	return append([]string{fmt.Sprintf("%d names backing off", len(r))}, r...)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,13 +12,20 @@ import (
 )
 
 type cache interface {
-	set(k string, v int, ttl time.Duration)
+	set(k string, v int, ev evidence, ttl time.Duration)
 	get(k string) int
+	// update the decision and evidence, keep TTL
+	update(k string, v int, ev evidence)
+	del(k string)
+	// iterate all entries
+	scan(f func(k string, v int, ev evidence))
+	// remaining TTL, negative if it never expires, 0 if not found
+	ttl(k string) time.Duration
 	info() string
 	close()
 }
 
-func cacheSave(c cache, req, res *dns.Msg, v int) {
+func cacheSave(p *profile, req, res *dns.Msg, v int, ev evidence) {
 	k := req.Question[0].Name
 	// ttl in DNS is uint31, so this is an impossible value to reach
 	ttl := ^uint32(0)
@@ -34,7 +42,11 @@ func cacheSave(c cache, req, res *dns.Msg, v int) {
 	if ex < *minTTL {
 		ex = *minTTL
 	}
-	go c.set(k, v, ex)
+	cacheWrite(p.cache, k, v, ev, ex)
+	if rk, ok := registrableKey(k); ok {
+		cacheWrite(p.cache, rk, v, ev, ex)
+	}
+	p.learn.learn(k, v)
 }
 
 func newCache(network, address string, index int) cache {
@@ -44,26 +56,62 @@ func newCache(network, address string, index int) cache {
 	return newRedisCache(network, address, index)
 }
 
+type mapEntry struct {
+	v  int
+	ev evidence
+}
+
 // simple cache for debug only, be aware TTL is ignored
 type mapCache struct {
-	m map[string]int
+	m map[string]mapEntry
 	l *sync.RWMutex
 }
 
 func newMapCache() *mapCache {
-	return &mapCache{map[string]int{}, &sync.RWMutex{}}
+	return &mapCache{map[string]mapEntry{}, &sync.RWMutex{}}
+}
+
+func (mc *mapCache) set(k string, v int, ev evidence, _ time.Duration) {
+	mc.update(k, v, ev)
+}
+
+func (mc *mapCache) get(k string) int {
+	mc.l.RLock()
+	defer mc.l.RUnlock()
+	return mc.m[k].v
 }
 
-func (mc *mapCache) set(k string, v int, _ time.Duration) {
+func (mc *mapCache) update(k string, v int, ev evidence) {
 	mc.l.Lock()
 	defer mc.l.Unlock()
-	mc.m[k] = v
+	mc.m[k] = mapEntry{v, ev}
 }
 
-func (mc *mapCache) get(k string) int {
+func (mc *mapCache) del(k string) {
+	mc.l.Lock()
+	defer mc.l.Unlock()
+	delete(mc.m, k)
+}
+
+func (mc *mapCache) scan(f func(k string, v int, ev evidence)) {
+	mc.l.RLock()
+	snapshot := make(map[string]mapEntry, len(mc.m))
+	for k, e := range mc.m {
+		snapshot[k] = e
+	}
+	mc.l.RUnlock()
+	for k, e := range snapshot {
+		f(k, e.v, e.ev)
+	}
+}
+
+func (mc *mapCache) ttl(k string) time.Duration {
 	mc.l.RLock()
 	defer mc.l.RUnlock()
-	return mc.m[k]
+	if _, in := mc.m[k]; !in {
+		return 0
+	}
+	return -1
 }
 
 func (mc *mapCache) info() string {
@@ -98,15 +146,36 @@ func newRedisCache(network, address string, index int) *redisCache {
 	return (*redisCache)(r)
 }
 
-func (rc *redisCache) set(k string, v int, ttl time.Duration) {
+// values are stored as "decision|evidence", see evidence.encode()
+// or just "decision" by earlier versions
+func (rc *redisCache) set(k string, v int, ev evidence, ttl time.Duration) {
 	conn := (*redis.Pool)(rc).Get()
 	defer conn.Close()
-	_, err := conn.Do("SETEX", k, int(ttl/time.Second), v)
+	_, err := conn.Do("SETEX", k, int(ttl/time.Second), strconv.Itoa(v)+ev.encode())
 	if err != nil {
 		log.Printf("failed to save %s to cache: %v", k, err)
 	}
 }
 
+func parseRedisValue(r interface{}) (int, evidence) {
+	s, err := redis.String(r, nil)
+	if err != nil {
+		log.Printf("failed to convert result to string: %v", r)
+		return noDecision, nil
+	}
+	ev := evidence(nil)
+	if sep := strings.IndexByte(s, '|'); sep != -1 {
+		ev = decodeEvidence(s[sep:])
+		s = s[:sep]
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("failed to convert result to int: %v", s)
+		return noDecision, nil
+	}
+	return i, ev
+}
+
 func (rc *redisCache) get(k string) int {
 	conn := (*redis.Pool)(rc).Get()
 	defer conn.Close()
@@ -119,12 +188,70 @@ func (rc *redisCache) get(k string) int {
 		// log.Printf("cache miss: %s", k)
 		return noDecision
 	}
-	i, err := redis.Int(r, nil)
+	i, _ := parseRedisValue(r)
+	return i
+}
+
+func (rc *redisCache) update(k string, v int, ev evidence) {
+	conn := (*redis.Pool)(rc).Get()
+	defer conn.Close()
+	// KEEPTTL requires redis 6.0
+	_, err := conn.Do("SET", k, strconv.Itoa(v)+ev.encode(), "XX", "KEEPTTL")
 	if err != nil {
-		log.Printf("failed to convert result to int: %v", r)
-		return noDecision
+		log.Printf("failed to update %s in cache: %v", k, err)
 	}
-	return i
+}
+
+func (rc *redisCache) del(k string) {
+	conn := (*redis.Pool)(rc).Get()
+	defer conn.Close()
+	if _, err := conn.Do("DEL", k); err != nil {
+		log.Printf("failed to delete %s from cache: %v", k, err)
+	}
+}
+
+func (rc *redisCache) scan(f func(k string, v int, ev evidence)) {
+	conn := (*redis.Pool)(rc).Get()
+	defer conn.Close()
+	cursor := 0
+	for {
+		r, err := redis.Values(conn.Do("SCAN", cursor, "COUNT", 1000))
+		if err != nil {
+			log.Printf("redis error: %v", err)
+			return
+		}
+		keys, _ := redis.Strings(r[1], nil)
+		for _, k := range keys {
+			v, err := conn.Do("GET", k)
+			if err != nil || v == nil {
+				continue
+			}
+			i, ev := parseRedisValue(v)
+			f(k, i, ev)
+		}
+		cursor, _ = redis.Int(r[0], nil)
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+func (rc *redisCache) ttl(k string) time.Duration {
+	conn := (*redis.Pool)(rc).Get()
+	defer conn.Close()
+	r, err := redis.Int(conn.Do("TTL", k))
+	if err != nil {
+		log.Printf("failed to get TTL of %s from cache: %v", k, err)
+		return 0
+	}
+	switch {
+	case r == -1:
+		return -1
+	case r < 0:
+		// -2 for not found
+		return 0
+	}
+	return time.Duration(r) * time.Second
 }
 
 func (rc *redisCache) info() string {
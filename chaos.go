@@ -1,8 +1,12 @@
 package main
 
-import "github.com/miekg/dns"
+import (
+	"strings"
 
-func handleAsTXT(w dns.ResponseWriter, req *dns.Msg, txt string) {
+	"github.com/miekg/dns"
+)
+
+func handleAsTXT(w dns.ResponseWriter, req *dns.Msg, txt ...string) {
 	rr := dns.TXT{
 		Hdr: dns.RR_Header{
 			Name:   req.Question[0].Name,
@@ -10,7 +14,7 @@ func handleAsTXT(w dns.ResponseWriter, req *dns.Msg, txt string) {
 			Class:  dns.ClassCHAOS,
 			Ttl:    0,
 		},
-		Txt: []string{txt},
+		Txt: txt,
 	}
 	res := dns.Msg{}
 	res.SetRcode(req, dns.RcodeSuccess)
@@ -18,7 +22,7 @@ func handleAsTXT(w dns.ResponseWriter, req *dns.Msg, txt string) {
 	w.WriteMsg(&res)
 }
 
-func handleCHAOS(w dns.ResponseWriter, req *dns.Msg) {
+func handleCHAOS(p *profile, w dns.ResponseWriter, req *dns.Msg) {
 	q := &req.Question[0]
 	if q.Qtype != dns.TypeTXT {
 		handleWith(w, req, dns.RcodeNotImplemented)
@@ -27,10 +31,39 @@ func handleCHAOS(w dns.ResponseWriter, req *dns.Msg) {
 		handleAsTXT(w, req, decisionCache.info())
 		return
 	}
+	if q.Name == "stats.diverge." {
+		handleAsTXT(w, req, statsInfo()...)
+		return
+	}
+	if q.Name == "audit.diverge." {
+		handleAsTXT(w, req, auditInfo()...)
+		return
+	}
+	if q.Name == "health.diverge." {
+		handleAsTXT(w, req, healthInfo()...)
+		return
+	}
+	if q.Name == "backoff.diverge." {
+		handleAsTXT(w, req, backoffInfo()...)
+		return
+	}
+	if q.Name == "learned.diverge." {
+		handleAsTXT(w, req, p.learn.info()...)
+		return
+	}
+	if strings.HasSuffix(q.Name, ".forget.diverge.") {
+		d := strings.TrimSuffix(q.Name, "forget.diverge.")
+		if p.learn.forget(strings.ToLower(d)) {
+			handleAsTXT(w, req, "deleted "+d)
+		} else {
+			handleAsTXT(w, req, "no learned rule "+d)
+		}
+		return
+	}
 	if ip, ok := ptrName4ToUint32(q.Name); ok {
-		handleAsTXT(w, req, ip4ToStr(ip))
+		handleAsTXT(w, req, ip4ToStr(p, ip))
 	} else {
-		dec := decisionCache.get(q.Name)
+		dec := cacheLookup(p, q.Name)
 		handleAsTXT(w, req, decisionToStr(dec))
 	}
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -28,8 +30,8 @@ func decisionToStr(dec int) string {
 	}
 }
 
-func ip4ToStr(ip uint32) string {
-	v := ipMap.Get(ip)
+func ip4ToStr(p *profile, ip uint32) string {
+	v := p.ipMap.Get(ip)
 	switch v {
 	case ipUnknown:
 		return decisionToStr(upstreamX)
@@ -40,17 +42,46 @@ func ip4ToStr(ip uint32) string {
 	}
 }
 
+// answers with these rcodes are treated as errors, see -fail-rcodes
+var failRcodes = map[int]bool{}
+
 func exchange(m *dns.Msg, dec int) (r *dns.Msg, rtt time.Duration, err error) {
-	client := &dns.Client{}
-	client.UDPSize = uint16(*UDPSize)
-	for _, addr := range upstream[dec-upstreamX] {
+	release, err := limitAcquire(dec)
+	if err != nil {
+		return
+	}
+	defer release()
+	if g := upstream[dec-upstreamX]; g.iter != nil {
+		start := time.Now()
+		r, err = g.iter.resolve(m, dec)
+		return r, time.Since(start), err
+	}
+	client := newClient(dec)
+	tried := 0
+	for _, addr := range orderAddrs(upstream[dec-upstreamX].get()) {
+		if !healthAvailable(addr) {
+			continue
+		}
+		tried++
 		r, rtt, err = client.Exchange(m, addr)
+		if err == nil && failRcodes[r.Rcode] {
+			err = fmt.Errorf("%s from %s", dns.RcodeToString[r.Rcode], addr)
+		}
+		healthReport(dec, addr, err)
+		rttReport(addr, rtt, err)
 		if err != nil {
 			continue
 		} else {
 			break
 		}
 	}
+	if tried == 0 {
+		if len(upstream[dec-upstreamX].get()) == 0 {
+			err = fmt.Errorf("no addresses of %s", decisionToStr(dec))
+		} else {
+			err = fmt.Errorf("all addresses of %s are down", decisionToStr(dec))
+		}
+	}
 	return
 }
 
@@ -60,17 +91,36 @@ func handleWith(w dns.ResponseWriter, req *dns.Msg, rcode int) {
 	w.WriteMsg(res)
 }
 
-func handleBy(w dns.ResponseWriter, req *dns.Msg, dec int) {
-	res, _, err := exchange(req, dec)
+func handleBy(p *profile, w dns.ResponseWriter, req *dns.Msg, dec int) {
+	if to := failoverOf(dec); to != dec {
+		log.Printf("\tfailover %s: %s -> %s", req.Question[0].Name, decisionToStr(dec), decisionToStr(to))
+		dec = to
+	}
+	res, _, err := exchangeECS(req, dec, clientIP(w))
 	if err != nil {
-		log.Printf("%v\n", err)
+		log.Printf("\tupstream %s error: %v", decisionToStr(dec), err)
+		if !handleStale(p, w, req, dec) {
+			handleWith(w, req, dns.RcodeServerFailure)
+		}
 		return
 	}
 	// log.Printf("Answer %v: %v\n", rtt, res)
+	if dec == upstreamX {
+		var owner int
+		res, owner = strictX(p, w, req, res)
+		// cached as X before, from now on go to the owner directly
+		if owner != upstreamX && req.Question[0].Qtype == dns.TypeA && p.cache.get(req.Question[0].Name) == upstreamX {
+			cacheSave(p, req, res, owner, nil)
+		}
+		dec = owner
+	} else if req.Question[0].Qtype == dns.TypeANY {
+		filterANY(p, res, dec)
+	}
 	w.WriteMsg(res)
+	staleSave(req, res, dec)
 }
 
-func handleDivergeTypeASeq(w dns.ResponseWriter, req *dns.Msg) int {
+func handleDivergeTypeASeq(p *profile, w dns.ResponseWriter, req *dns.Msg) int {
 	nErr := 0
 	for i := 1; i < len(upstream); i++ {
 		// 1 -> upstreamA
@@ -79,12 +129,12 @@ func handleDivergeTypeASeq(w dns.ResponseWriter, req *dns.Msg) int {
 		if err != nil {
 			log.Printf("upstream %s error: %v", decisionToStr(decision), err)
 			nErr++
-		} else if postChk(res, i-1+ipA) {
+		} else if postChk(p, res, i-1+ipA) {
 			if w != nil {
 				w.WriteMsg(res)
 			}
 			if nErr == 0 {
-				cacheSave(decisionCache, req, res, decision)
+				cacheSave(p, req, res, decision, nil)
 			}
 			return decision
 		}
@@ -97,7 +147,7 @@ func handleDivergeTypeASeq(w dns.ResponseWriter, req *dns.Msg) int {
 			w.WriteMsg(res)
 		}
 		if nErr == 0 {
-			cacheSave(decisionCache, req, res, upstreamX)
+			cacheSave(p, req, res, upstreamX, nil)
 		}
 		return upstreamX
 	}
@@ -109,58 +159,145 @@ type response struct {
 	err error
 }
 
-func finalDecision(w dns.ResponseWriter, req, res *dns.Msg, decision, nErr int) {
+func finalDecision(p *profile, w dns.ResponseWriter, req, res *dns.Msg, decision, nErr int, ev evidence) {
+	// what X answered, a stripped answer may have no A records left to take the TTL from,
+	// the name is still cached as X, so it's stripped again instead of probed on every query
+	saved := res
+	if decision == upstreamX {
+		res, decision = strictX(p, w, req, res)
+		if decision != upstreamX {
+			saved = res
+			// the probe shows the owner didn't match, so it can't be reclassified by it
+			ev = nil
+		}
+	}
 	if w != nil {
 		w.WriteMsg(res)
 	}
+	staleSave(req, res, decision)
 	if nErr == 0 {
-		cacheSave(decisionCache, req, res, decision)
+		cacheSave(p, req, saved, decision, ev)
+		if decision == upstreamX && *probePort > 0 {
+			if ip := unlistedAddr(p, res); ip != nil {
+				go probeConnect(p, req.Copy(), res.Copy(), ip)
+			}
+		}
 	}
 	log.Printf("\tdecision %s: %s", req.Question[0].Name, decisionToStr(decision))
 }
 
-func handleDivergeTypeA(w dns.ResponseWriter, req *dns.Msg) int {
+var (
+	probes      = newCounter("probes")
+	probesX     = newCounter("probes-x")
+	probesXSkip = newCounter("probes-x-saved")
+)
+
+func handleDivergeTypeA(p *profile, w dns.ResponseWriter, req *dns.Msg) int {
+	probes.inc()
 	rArray := make([]chan response, len(upstream))
 	for i := range upstream {
-		decision := i + upstreamX
 		rArray[i] = make(chan response, 1)
-		go func(req dns.Msg, dec int, r chan<- response) {
-			res, _, err := exchange(&req, dec)
+	}
+	client := clientIP(w)
+	query := func(decision int) {
+		// a deep copy, packing writes to the OPT record
+		go func(req *dns.Msg, dec int, r chan<- response) {
+			res, _, err := exchangeECS(req, dec, client)
 			r <- response{res, err}
 			close(r)
-		}(*req, decision, rArray[i])
+		}(req.Copy(), decision, rArray[decision-upstreamX])
+	}
+	// in hedged mode upstream X is only queried after a delay,
+	// or as soon as an A-side upstream fails or doesn't match
+	var onceX sync.Once
+	queryX := func() {
+		onceX.Do(func() {
+			probesX.inc()
+			query(upstreamX)
+		})
+	}
+	if *hedge > 0 {
+		t := time.AfterFunc(*hedge, queryX)
+		defer t.Stop()
+	} else {
+		queryX()
+	}
+	for _, i := range p.links {
+		query(i + upstreamA)
 	}
 	nErr := 0
-	for i, r := range rArray[1:] {
+	reasons := []string{}
+	ev := make(evidence, len(upstream))
+	for _, i := range p.links {
 		decision := i + upstreamA
-		res := <-r
+		res := <-rArray[i+1]
 		if res.err != nil {
 			log.Printf("\tupstream %s error: %v", decisionToStr(decision), res.err)
 			nErr++
-		} else if postChk(res.msg, i+ipA) {
-			finalDecision(w, req, res.msg, decision, nErr)
+			reasons = append(reasons, decisionToStr(decision)+": "+res.err.Error())
+			queryX()
+			continue
+		}
+		ev.addAnswer(i+1, res.msg)
+		if postChk(p, res.msg, i+ipA) {
+			// if X is not queried yet, it will never be
+			onceX.Do(probesXSkip.inc)
+			finalDecision(p, w, req, res.msg, decision, nErr, ev)
+			if nErr > 0 {
+				backoffSave(p, req.Question[0].Name, decision, reasons)
+			}
 			return decision
 		}
+		queryX()
 	}
+	queryX()
 	res := <-(rArray[0])
 	if res.err != nil {
 		log.Printf("\tupstream %s error: %v", decisionToStr(upstreamX), res.err)
 		nErr++
+		reasons = append(reasons, decisionToStr(upstreamX)+": "+res.err.Error())
 	} else {
-		finalDecision(w, req, res.msg, upstreamX, nErr)
+		ev.addAnswer(0, res.msg)
+		finalDecision(p, w, req, res.msg, upstreamX, nErr, ev)
+		if nErr > 0 {
+			backoffSave(p, req.Question[0].Name, upstreamX, reasons)
+		}
 		return upstreamX
 	}
+	backoffSave(p, req.Question[0].Name, noDecision, reasons)
+	// when probing for other types, it's up to the caller
+	if _, probing := w.(probeWriter); w != nil && !probing && !handleStale(p, w, req, noDecision) {
+		handleWith(w, req, dns.RcodeServerFailure)
+	}
 	return noDecision
 }
 
-func handleDivergeTypeOther(w dns.ResponseWriter, req *dns.Msg) {
+// discards answers, for probing on behalf of a client
+type probeWriter struct {
+	dns.ResponseWriter
+}
+
+func (probeWriter) WriteMsg(*dns.Msg) error {
+	return nil
+}
+
+func handleDivergeTypeOther(p *profile, w dns.ResponseWriter, req *dns.Msg) {
 	qA := new(dns.Msg)
 	qA.SetQuestion(req.Question[0].Name, dns.TypeA)
-	decision := handleDivergeTypeA(nil, qA)
+	// so the probe sees the same client subnet
+	if e := getECS(req); e != nil {
+		qA.SetEdns0(ednsUDPSize, false)
+		opt := qA.IsEdns0()
+		opt.Option = append(opt.Option, e)
+	}
+	decision := handleDivergeTypeA(p, probeWriter{w}, qA)
 	if decision == noDecision {
+		if !handleStale(p, w, req, noDecision) {
+			handleWith(w, req, dns.RcodeServerFailure)
+		}
 		return
 	}
-	handleBy(w, req, decision)
+	handleBy(p, w, req, decision)
 }
 
 func handle(w dns.ResponseWriter, req *dns.Msg) {
@@ -171,48 +308,64 @@ func handle(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 	q := &req.Question[0]
-	log.Printf("query: %s %s %s\n", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+	p := profileOf(w)
+	if p == defaultProfile {
+		log.Printf("query: %s %s %s\n", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
+	} else {
+		log.Printf("query: %s %s %s, profile %s\n", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype], p.name)
+	}
 	if q.Qclass == dns.ClassCHAOS {
-		handleCHAOS(w, req)
+		handleCHAOS(p, w, req)
 		return
 	} else if q.Qclass != dns.ClassINET {
 		log.Printf("\tquery class not supported: %s\n", dns.ClassToString[q.Qclass])
 		handleWith(w, req, dns.RcodeNotImplemented)
 		return
 	}
+	if !queryAdmit() {
+		log.Printf("\tshed, too many queries in flight\n")
+		handleWith(w, req, shedRcode)
+		return
+	}
+	defer queryDone()
 	// fmt.Printf("req: %v\n", req)
-	upstream, rcode := preChk(q)
+	if q.Qtype == dns.TypeANY && handleANY(w, req) {
+		return
+	}
+	upstream, rcode := preChk(p, q)
 	if rcode != dns.RcodeSuccess {
 		log.Printf("\tpreChk %s: %s\n", q.Name, dns.RcodeToString[rcode])
 		handleWith(w, req, rcode)
 		return
 	}
 	log.Printf("\tpreChk %s: %s\n", q.Name, decisionToStr(upstream))
+	if q.Qtype != dns.TypePTR && auditSample() {
+		go auditName(p, q.Name, upstream)
+	}
 	switch upstream {
 	case noDecision:
-		switch req.Question[0].Qtype {
-		case dns.TypeA:
-			handleDivergeTypeA(w, req)
-		default:
-			handleDivergeTypeOther(w, req)
-		}
+		coalesce(p, w, req, func(w dns.ResponseWriter) {
+			switch req.Question[0].Qtype {
+			case dns.TypeA:
+				handleDivergeTypeA(p, w, req)
+			default:
+				handleDivergeTypeOther(p, w, req)
+			}
+		})
 	default:
-		handleBy(w, req, upstream)
+		handleBy(p, w, req, upstream)
 	}
 }
 
-func preChk(q *dns.Question) (upstream, rcode int) {
+func preChk(p *profile, q *dns.Question) (upstream, rcode int) {
 	switch q.Qtype {
-	case dns.TypeANY:
-		log.Print("\tquery type ANY not supported\n")
-		return noDecision, dns.RcodeNotImplemented
 	case dns.TypePTR:
 		// to do: IPv6 PTR is not handled
 		ip, ok := ptrName4ToUint32(q.Name)
 		if !ok {
 			return noDecision, dns.RcodeRefused
 		}
-		ipV := ipMap.Get(ip)
+		ipV := p.ipMap.Get(ip)
 		switch ipV {
 		case ipPrivate:
 			return noDecision, dns.RcodeRefused
@@ -222,18 +375,62 @@ func preChk(q *dns.Question) (upstream, rcode int) {
 			return upstreamA + ipV - ipA, dns.RcodeSuccess
 		}
 	}
-	if block.includes(q.Name) {
+	if p.block.includes(q.Name) {
 		return noDecision, dns.RcodeRefused
 	}
-	return decisionCache.get(q.Name), dns.RcodeSuccess
+	if dec, ok := typeRoute(p, q); ok {
+		return dec, dns.RcodeSuccess
+	}
+	dec := cacheLookup(p, q.Name)
+	if dec != noDecision {
+		p.hits.hit(q.Name)
+	} else {
+		dec = backoffLookup(p, q.Name)
+	}
+	return dec, dns.RcodeSuccess
 }
 
-func filterRR(rrs []dns.RR, v int) (int, []dns.RR) {
+func postChk(p *profile, m *dns.Msg, v int) bool {
+	dec := upstreamA + v - ipA
+	in, out := splitRR(p, m.Answer, v)
+	match := policyMatch(dec, len(in), len(out))
+	if len(in) == 0 || len(out) == 0 {
+		// not mixed, the policy doesn't matter
+		if match {
+			_, m.Extra = filterRR(p, m.Extra, v)
+		}
+		return match
+	}
+	name := m.Question[0].Name
+	total := len(in) + len(out)
+	switch mixedPolicy[dec] {
+	case policyFilter:
+		log.Printf("\tpostChk %s: %s, dropped %d of %d A records out of set", name, decisionToStr(dec), len(out), total)
+		_, m.Answer = filterRR(p, m.Answer, v)
+		_, m.Extra = filterRR(p, m.Extra, v)
+	case policyKeepAll:
+		log.Printf("\tpostChk %s: %s, kept %d of %d A records out of set", name, decisionToStr(dec), len(out), total)
+	case policyRequireAll:
+		log.Printf("\tpostChk %s: %s, rejected, %d of %d A records out of set", name, decisionToStr(dec), len(out), total)
+	case policyReorder:
+		log.Printf("\tpostChk %s: %s, moved %d of %d A records out of set last", name, decisionToStr(dec), len(out), total)
+		sorted := append(in, out...)
+		for i, rr := range m.Answer {
+			if _, ok := rr.(*dns.A); ok {
+				m.Answer[i] = sorted[0]
+				sorted = sorted[1:]
+			}
+		}
+	}
+	return match
+}
+
+func filterRR(p *profile, rrs []dns.RR, v int) (int, []dns.RR) {
 	filtered := make([]dns.RR, 0, len(rrs))
 	var nA int
 	for _, rr := range rrs {
 		if rr.Header().Rrtype == dns.TypeA {
-			if ipMap.GetIP(rr.(*dns.A).A) == v {
+			if inSet(p, rr.(*dns.A).A, v) {
 				nA++
 				filtered = append(filtered, rr)
 			}
@@ -243,10 +440,3 @@ func filterRR(rrs []dns.RR, v int) (int, []dns.RR) {
 	}
 	return nA, filtered
 }
-
-func postChk(m *dns.Msg, v int) bool {
-	var nA int
-	nA, m.Answer = filterRR(m.Answer, v)
-	_, m.Extra = filterRR(m.Extra, v)
-	return nA > 0
-}
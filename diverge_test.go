@@ -1,12 +1,27 @@
 package main
 
 import (
-	"ip4map"
+	"diverge/ip4map"
+	"errors"
+	"net"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
+// set once, probes return on a match while the query to X may still be running,
+// so it's read after the test is over
+func init() {
+	parseFailRcodes("SERVFAIL")
+}
+
 func TestDomainSet(t *testing.T) {
 	ds := newDomainSet("com.", "net.")
 	for _, e := range []struct {
@@ -58,9 +73,1339 @@ func TestIPMap(t *testing.T) {
 	}
 }
 
+func TestPostChkPolicy(t *testing.T) {
+	p := &profile{ipMap: ip4map.New(2, 24)}
+	p.ipMap.SetStr("10.0.0.0/8", ipPrivate)
+	p.ipMap.SetStr("1.0.0.0/8", ipA)
+	names = []string{"X", "A"}
+	defer delete(mixedPolicy, upstreamA)
+
+	answer := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		for _, s := range []string{
+			"example.com. 60 IN CNAME cdn.example.net.",
+			"cdn.example.net. 60 IN A 2.2.2.2",
+			"cdn.example.net. 60 IN A 1.1.1.1",
+		} {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+	for _, e := range []struct {
+		policy int
+		match  bool
+		a      []string
+	}{
+		{policyFilter, true, []string{"1.1.1.1"}},
+		{policyKeepAll, true, []string{"2.2.2.2", "1.1.1.1"}},
+		{policyRequireAll, false, []string{"2.2.2.2", "1.1.1.1"}},
+		{policyReorder, true, []string{"1.1.1.1", "2.2.2.2"}},
+	} {
+		mixedPolicy[upstreamA] = e.policy
+		m := answer()
+		if match := postChk(p, m, ipA); match != e.match {
+			t.Errorf("policy %d: postChk() = %v, expecting %v", e.policy, match, e.match)
+		}
+		if _, ok := m.Answer[0].(*dns.CNAME); !ok {
+			t.Errorf("policy %d: CNAME is not the first record", e.policy)
+		}
+		ips := answerIPs(m)
+		if len(ips) != len(e.a) {
+			t.Errorf("policy %d: got %v, expecting %v", e.policy, ips, e.a)
+			continue
+		}
+		for i, ip := range ips {
+			if ip.String() != e.a[i] {
+				t.Errorf("policy %d: got %v, expecting %v", e.policy, ips, e.a)
+				break
+			}
+		}
+	}
+}
+
+func TestWithECS(t *testing.T) {
+	names = []string{"X", "A", "B"}
+	parseECS("A=client,B=strip,X=203.0.113.0/24")
+	defer func() { ecs = map[int]ecsSetting{} }()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	client := net.ParseIP("198.51.100.77")
+	for _, e := range []struct {
+		dec    int
+		subnet string
+	}{
+		{upstreamA, "198.51.100.0/24/0"},
+		{upstreamA + 1, ""},
+		{upstreamX, "203.0.113.0/24/0"},
+	} {
+		q := withECS(req, e.dec, client)
+		o := getECS(q)
+		switch {
+		case e.subnet == "" && o != nil:
+			t.Errorf("%s: unexpected ECS %v", decisionToStr(e.dec), o)
+		case e.subnet != "" && (o == nil || o.String() != e.subnet):
+			t.Errorf("%s: got ECS %v, expecting %s", decisionToStr(e.dec), o, e.subnet)
+		}
+		// the client didn't send OPT, so it shouldn't get one in reply
+		r := q.Copy()
+		fixECSReply(req, r)
+		if r.IsEdns0() != nil {
+			t.Errorf("%s: OPT is not removed from reply", decisionToStr(e.dec))
+		}
+	}
+	if getECS(req) != nil {
+		t.Error("original query is modified")
+	}
+
+	// IPv6, no longer than the client sent
+	for _, e := range []struct {
+		sent   string
+		subnet string
+	}{
+		{"", "[2001:db8:1::]/56/0"},
+		{"2001:db8::/48", "[2001:db8::]/48/0"},
+		{"2001:db8:1:2::/64", "[2001:db8:1::]/56/0"},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if e.sent != "" {
+			_, n, _ := net.ParseCIDR(e.sent)
+			ones, _ := n.Mask.Size()
+			req.SetEdns0(ednsUDPSize, false)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, newSubnet(n.IP, ones))
+		}
+		if o := getECS(withECS(req, upstreamA, net.ParseIP("2001:db8:1:2::77"))); o == nil || o.String() != e.subnet {
+			t.Errorf("client ECS %q: got ECS %v, expecting %s", e.sent, o, e.subnet)
+		}
+	}
+}
+
+func TestEvidence(t *testing.T) {
+	p := &profile{links: []int{0}, ipMap: ip4map.New(2, 24)}
+	p.ipMap.SetStr("1.0.0.0/8", ipA)
+	upstream = testUpstreams([][]string{{"X"}, {"A"}})
+	ev := evidence{[]uint32{0x02020202}, []uint32{0x01010101, 0x03030303}}
+	s := ev.encode()
+	if s != "|2.2.2.2|1.1.1.1,3.3.3.3" {
+		t.Errorf("evidence.encode() = %s", s)
+	}
+	if d := decodeEvidence(s); d.encode() != s {
+		t.Errorf("decodeEvidence(\"%s\").encode() = %s", s, d.encode())
+	}
+	if dec, ok := ev.classify(p); !ok || dec != upstreamA {
+		t.Errorf("classify() = %d, %v, expecting %d", dec, ok, upstreamA)
+	}
+	// after reload
+	p.ipMap = ip4map.New(2, 24)
+	p.ipMap.SetStr("3.0.0.0/8", ipA)
+	if dec, ok := ev.classify(p); !ok || dec != upstreamA {
+		t.Errorf("classify() = %d, %v, expecting %d", dec, ok, upstreamA)
+	}
+	p.ipMap = ip4map.New(2, 24)
+	if dec, ok := ev.classify(p); !ok || dec != upstreamX {
+		t.Errorf("classify() = %d, %v, expecting %d", dec, ok, upstreamX)
+	}
+	if _, ok := decodeEvidence("||-").classify(p); ok {
+		t.Error("classify() should fail on unknown evidence")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	names = []string{"X", "A", "B"}
+	ipFiles = []string{"", ""}
+	block = newDomainSet()
+	decisionCache = newMapCache()
+	defaultProfile = newDefaultProfile()
+	profiles = []*profile{
+		parseProfile("guest 192.168.20.0/24 upstreams=X"),
+		parseProfile("lab 10.1.0.0/16,10.2.0.0/16 upstreams=B,A block=lan ns=l"),
+	}
+	defer func() { profiles = []*profile{} }()
+
+	for _, e := range []struct {
+		ip    string
+		p     string
+		links string
+	}{
+		{"192.168.20.7", "guest", "X"},
+		{"10.2.3.4", "lab", "B,A,X"},
+		{"192.168.1.1", "default", "A,B,X"},
+	} {
+		p := profileOf(&testWriter{addr: &net.UDPAddr{IP: net.ParseIP(e.ip), Port: 53}})
+		if p.name != e.p || p.info() != e.links {
+			t.Errorf("profileOf(%s) = %s (%s), expecting %s (%s)", e.ip, p.name, p.info(), e.p, e.links)
+		}
+	}
+	lab := profiles[1]
+	if profiles[0].ipMap == defaultProfile.ipMap || lab.ipMap != defaultProfile.ipMap {
+		t.Error("IP map shared with a profile not using all lists, or not shared with one using them all")
+	}
+	if !lab.block.includes("printer.lan.") || defaultProfile.block.includes("printer.lan.") {
+		t.Error("unexpected block list")
+	}
+	lab.cache.set("example.com.", upstreamA, nil, time.Hour)
+	if decisionCache.get("l/example.com.") != upstreamA || defaultProfile.cache.get("example.com.") != noDecision {
+		t.Error("unexpected cache namespace")
+	}
+}
+
+func TestTypeRoute(t *testing.T) {
+	names = []string{"X", "A"}
+	parseTypeRoute("TXT=X,mail.example.com/TXT=A,SOA=zone")
+	defer func() { typeRoutes = map[uint16]map[string]int{} }()
+	for _, e := range []struct {
+		qtype uint16
+		name  string
+		dec   int
+		ok    bool
+	}{
+		{dns.TypeTXT, "example.com.", upstreamX, true},
+		{dns.TypeTXT, "_dmarc.mail.example.com.", upstreamA, true},
+		{dns.TypeSOA, "example.com.", routeZone, true},
+		{dns.TypeMX, "example.com.", noDecision, false},
+	} {
+		dec, ok := typeRouteOf(e.qtype, e.name)
+		if dec != e.dec || ok != e.ok {
+			t.Errorf("typeRouteOf(%s, %s) = %d, %v, expecting %d, %v",
+				dns.TypeToString[e.qtype], e.name, dec, ok, e.dec, e.ok)
+		}
+	}
+
+	// a profile not going through A
+	setTestProfile()
+	guest := &profile{name: "guest", links: []int{}}
+	for _, e := range []struct {
+		p   *profile
+		dec int
+		ok  bool
+	}{
+		{defaultProfile, upstreamA, true},
+		{guest, noDecision, false},
+	} {
+		q := dns.Question{Name: "mail.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+		if dec, ok := typeRoute(e.p, &q); dec != e.dec || ok != e.ok {
+			t.Errorf("typeRoute(%s) = %s, %v, expecting %s, %v", e.p.name, decisionToStr(dec), ok, decisionToStr(e.dec), e.ok)
+		}
+	}
+}
+
+func TestFailRcodes(t *testing.T) {
+	bad := startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		handleWith(w, req, dns.RcodeServerFailure)
+	})
+	good := startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.1.1.1")
+		res.Answer = append(res.Answer, rr)
+		w.WriteMsg(res)
+	})
+	names = []string{"X"}
+	upstream = testUpstreams([][]string{{bad, good}})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	res, _, err := exchange(req, upstreamX)
+	if err != nil || len(res.Answer) != 1 {
+		t.Errorf("exchange() = %v, %v, expecting the answer from the 2nd address", res, err)
+	}
+	upstream = testUpstreams([][]string{{bad}})
+	if _, _, err = exchange(req, upstreamX); err == nil {
+		t.Error("SERVFAIL is not treated as an error")
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{{"X"}, {"A"}})
+	setTestProfile()
+	p := defaultProfile
+	*staleSize = 1
+	defer func() { *staleSize = 0 }()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(ednsUDPSize, false)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	rr, _ := dns.NewRR("example.com. 3600 IN A 1.1.1.1")
+	res.Answer = append(res.Answer, rr)
+	staleSave(req, res, upstreamA)
+
+	w := &testWriter{}
+	if !handleStale(p, w, req, noDecision) || len(w.msgs) != 1 {
+		t.Fatal("no stale answer served")
+	}
+	stale := w.msgs[0]
+	if len(stale.Answer) != 1 || stale.Answer[0].Header().Ttl != uint32(*staleTTL/time.Second) {
+		t.Errorf("unexpected stale answer: %v", stale)
+	}
+	if opt := stale.IsEdns0(); opt == nil || len(opt.Option) != 1 ||
+		opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("stale answer is not marked: %v", stale)
+	}
+	if res.Answer[0].Header().Ttl != 3600 {
+		t.Error("original answer is modified")
+	}
+
+	// saved with the first client's subnet
+	withSubnet := func(m *dns.Msg, ip net.IP) *dns.Msg {
+		m = m.Copy()
+		m.SetEdns0(ednsUDPSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, newSubnet(ip, 24))
+		return m
+	}
+	staleSave(req, withSubnet(res, net.IPv4(198, 51, 100, 0)), upstreamA)
+	plain := new(dns.Msg)
+	plain.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	w = &testWriter{}
+	if !handleStale(p, w, plain, noDecision) || w.msgs[0].IsEdns0() != nil || w.msgs[0].Question[0].Name != "EXAMPLE.com." {
+		t.Errorf("unexpected stale answer to a client without EDNS: %v", w.msgs)
+	}
+	w = &testWriter{}
+	own := withSubnet(req, net.IPv4(203, 0, 113, 0))
+	if !handleStale(p, w, own, noDecision) {
+		t.Fatal("no stale answer served")
+	} else if e := getECS(w.msgs[0]); e == nil || !e.Address.Equal(net.IPv4(203, 0, 113, 0)) {
+		t.Errorf("stale answer with ECS of another %v", e)
+	}
+
+	// not to a profile not using A
+	guest := &profile{name: "guest", links: []int{}}
+	if handleStale(guest, w, req, noDecision) {
+		t.Error("stale answer of A served to a profile not using A")
+	}
+	// nor once too old
+	*staleMax = time.Nanosecond
+	if handleStale(p, w, req, noDecision) {
+		t.Error("stale answer served beyond -stale-max")
+	}
+	*staleMax = 24 * time.Hour
+
+	// only the most recent one is kept
+	other := req.Copy()
+	other.SetQuestion("example.net.", dns.TypeA)
+	staleSave(other, res, upstreamX)
+	if handleStale(p, w, req, noDecision) {
+		t.Error("stale answer should be evicted")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	names = []string{"X"}
+	addr := "192.0.2.1:53"
+	*breakerFailures = 3
+	defer func() { *breakerFailures = 0 }()
+	*breakerCooldown = 100 * time.Millisecond
+	for i := 0; i < *breakerFailures; i++ {
+		if !healthAvailable(addr) {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		healthReport(upstreamX, addr, errors.New("timeout"))
+	}
+	if healthAvailable(addr) {
+		t.Fatal("breaker is not open")
+	}
+	time.Sleep(*breakerCooldown)
+	if !healthAvailable(addr) {
+		t.Fatal("no query is let through after cooldown")
+	}
+	if healthAvailable(addr) {
+		t.Fatal("only one query should be let through")
+	}
+	healthReport(upstreamX, addr, nil)
+	if !healthAvailable(addr) {
+		t.Fatal("breaker is not closed after recovery")
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	*rttOrder = true
+	*rttExplore = 0
+	defer func() { *rttOrder = false }()
+	rttReport("192.0.2.11:53", 50*time.Millisecond, nil)
+	rttReport("192.0.2.12:53", 10*time.Millisecond, nil)
+	rttReport("192.0.2.13:53", 0, errors.New("timeout"))
+	addrs := []string{"192.0.2.13:53", "192.0.2.11:53", "192.0.2.12:53", "192.0.2.14:53"}
+	ordered := orderAddrs(addrs)
+	expected := []string{"192.0.2.14:53", "192.0.2.12:53", "192.0.2.11:53", "192.0.2.13:53"}
+	for i := range expected {
+		if ordered[i] != expected[i] {
+			t.Fatalf("orderAddrs() = %v, expecting %v", ordered, expected)
+		}
+	}
+	if addrs[0] != "192.0.2.13:53" {
+		t.Error("original list is modified")
+	}
+}
+
+func TestAcceptSpecial(t *testing.T) {
+	p := &profile{ipMap: ip4map.New(2, 24)}
+	p.ipMap.SetStr("10.0.0.0/8", ipPrivate)
+	p.ipMap.SetStr("192.168.0.0/16", ipPrivate)
+	names = []string{"X", "A", "corp"}
+	parseAcceptSpecial("corp=10.0.0.0/8")
+	defer func() { acceptSpecial = map[int][]*net.IPNet{} }()
+	for _, e := range []struct {
+		ip string
+		v  int
+		r  bool
+	}{
+		{"10.1.2.3", ipA + 1, true},
+		{"10.1.2.3", ipA, false},
+		{"192.168.1.1", ipA + 1, false},
+	} {
+		if r := inSet(p, net.ParseIP(e.ip), e.v); r != e.r {
+			t.Errorf("inSet(%s, %d) = %v, expecting %v", e.ip, e.v, r, e.r)
+		}
+	}
+}
+
+func TestStrictStrip(t *testing.T) {
+	p := &profile{links: []int{0}, ipMap: ip4map.New(2, 24)}
+	p.ipMap.SetStr("1.0.0.0/8", ipA)
+	names = []string{"X", "A"}
+	parseStrict("strip")
+	defer parseStrict("")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	for _, s := range []string{"example.com. 60 IN A 1.1.1.1", "example.com. 60 IN A 2.2.2.2"} {
+		rr, _ := dns.NewRR(s)
+		res.Answer = append(res.Answer, rr)
+	}
+	stripped, dec := strictX(p, nil, req, res)
+	if ips := answerIPs(stripped); len(ips) != 1 || ips[0].String() != "2.2.2.2" || dec != upstreamX {
+		t.Errorf("strictX() = %v, %s, expecting only 2.2.2.2 from X", ips, decisionToStr(dec))
+	}
+	if len(res.Answer) != 2 {
+		t.Error("original answer is modified")
+	}
+	// A is not for clients of guest, nothing to strip
+	guest := &profile{name: "guest", links: []int{}, ipMap: p.ipMap}
+	if same, dec := strictX(guest, nil, req, res); len(answerIPs(same)) != 2 || dec != upstreamX {
+		t.Errorf("strictX() of guest = %v, %s, expecting the answer of X", answerIPs(same), decisionToStr(dec))
+	}
+}
+
+func TestStrictCache(t *testing.T) {
+	var nA int32
+	answer := func(a ...string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			// the probe gets an answer out of set, A is requeried for the rest
+			i := 0
+			if len(a) > 1 && atomic.AddInt32(&nA, 1) > 1 {
+				i = 1
+			}
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + a[i])
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		}
+	}
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{{startTestServer(t, answer("1.1.1.1"))}, {startTestServer(t, answer("3.3.3.3", "1.1.1.2"))}})
+	defer parseStrict("")
+	query := func(name string) *dns.Msg {
+		w := &testWriter{}
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		handle(w, req)
+		if len(w.msgs) != 1 {
+			t.Fatalf("got %d answers", len(w.msgs))
+		}
+		// cache writes are in background
+		time.Sleep(10 * time.Millisecond)
+		return w.msgs[0]
+	}
+
+	// the owner's decision is cached when requeried
+	setTestProfile()
+	parseStrict("requery")
+	m := query("example.com.")
+	if ips := answerIPs(m); len(ips) != 1 || ips[0].String() != "1.1.1.2" {
+		t.Errorf("expecting the answer of A, got %v", m)
+	}
+	if dec := defaultProfile.cache.get("example.com."); dec != upstreamA {
+		t.Errorf("requeried name cached as %s", decisionToStr(dec))
+	}
+	// the probe's evidence is against A, so none is kept
+	reclassifyProfile(defaultProfile)
+	if dec := defaultProfile.cache.get("example.com."); dec != upstreamA {
+		t.Errorf("requeried name reclassified as %s", decisionToStr(dec))
+	}
+
+	// stripped to nothing, still cached as X
+	setTestProfile()
+	parseStrict("strip")
+	atomic.StoreInt32(&nA, 0)
+	if m := query("example.net."); len(answerIPs(m)) != 0 {
+		t.Errorf("expecting all stripped, got %v", m)
+	}
+	if dec := defaultProfile.cache.get("example.net."); dec != upstreamX {
+		t.Errorf("stripped name cached as %s", decisionToStr(dec))
+	}
+}
+
+func TestConnectRTT(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	*probePort = l.Addr().(*net.TCPAddr).Port
+	defer func() { *probePort = 0 }()
+	names = []string{"X", "A"}
+	parseBind("A=127.0.0.1")
+	defer func() { bindAddr = map[int]net.IP{} }()
+	for _, dec := range []int{upstreamX, upstreamA} {
+		if _, err := connectRTT(dec, net.ParseIP("127.0.0.1")); err != nil {
+			t.Errorf("connectRTT() via %s: %v", decisionToStr(dec), err)
+		}
+	}
+
+	p := &profile{ipMap: ip4map.New(2, 24)}
+	p.ipMap.SetStr("1.0.0.0/8", ipA)
+	res := new(dns.Msg)
+	rr, _ := dns.NewRR("example.com. 60 IN A 2.2.2.2")
+	res.Answer = append(res.Answer, rr)
+	if ip := unlistedAddr(p, res); ip == nil || ip.String() != "2.2.2.2" {
+		t.Errorf("unlistedAddr() = %v, expecting 2.2.2.2", ip)
+	}
+	rr, _ = dns.NewRR("example.com. 60 IN A 1.1.1.1")
+	res.Answer = append(res.Answer, rr)
+	if ip := unlistedAddr(p, res); ip != nil {
+		t.Errorf("unlistedAddr() = %v, expecting nil", ip)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	names = []string{"X", "A", "B"}
+	upstream = testUpstreams([][]string{{"192.0.2.20:53"}, {"192.0.2.21:53", "192.0.2.22:53"}, {"192.0.2.23:53"}})
+	*failoverAfter = time.Nanosecond
+	*breakerFailures = 3
+	defer func() { *failoverAfter, *breakerFailures = 0, 0 }()
+	parseFailover("A=B")
+	defer func() { failoverTo = map[int]int{} }()
+
+	down := func(addr string) {
+		for i := 0; i < *breakerFailures; i++ {
+			healthReport(upstreamA, addr, errors.New("timeout"))
+		}
+	}
+	down("192.0.2.21:53")
+	if to := failoverOf(upstreamA); to != upstreamA {
+		t.Errorf("failoverOf(A) = %s with one address still up", decisionToStr(to))
+	}
+	down("192.0.2.22:53")
+	if to := failoverOf(upstreamA); to != upstreamA+1 {
+		t.Errorf("failoverOf(A) = %s, expecting B", decisionToStr(to))
+	}
+	down("192.0.2.23:53")
+	if to := failoverOf(upstreamA); to != upstreamX {
+		t.Errorf("failoverOf(A) = %s, expecting X", decisionToStr(to))
+	}
+	healthReport(upstreamA, "192.0.2.22:53", nil)
+	if to := failoverOf(upstreamA); to != upstreamA {
+		t.Errorf("failoverOf(A) = %s after recovery", decisionToStr(to))
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var nX, nA int32
+	upstreamServer := func(n *int32, a string) string {
+		return startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(n, 1)
+			// so the queries overlap
+			time.Sleep(200 * time.Millisecond)
+			res := new(dns.Msg)
+			res.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + a)
+			res.Answer = append(res.Answer, rr)
+			// echo EDNS options, like ECS
+			if opt := req.IsEdns0(); opt != nil {
+				res.SetEdns0(opt.UDPSize(), false)
+				res.IsEdns0().Option = opt.Option
+			}
+			w.WriteMsg(res)
+		})
+	}
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{{upstreamServer(&nX, "2.2.2.2")}, {upstreamServer(&nA, "1.1.1.1")}})
+	setTestProfile()
+
+	const n = 10
+	writers := make([]*testWriter, n)
+	var wg sync.WaitGroup
+	for i := range writers {
+		writers[i] = &testWriter{}
+		wg.Add(1)
+		go func(w *testWriter, id uint16) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.Id = id
+			// EDNS with a subnet of its own for even ones
+			if id%2 == 0 {
+				req.SetEdns0(ednsUDPSize, false)
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, newSubnet(net.IPv4(10, 0, byte(id), 0), 24))
+			}
+			handle(w, req)
+		}(writers[i], uint16(i))
+	}
+	wg.Wait()
+
+	if x, a := atomic.LoadInt32(&nX), atomic.LoadInt32(&nA); x != 1 || a != 1 {
+		t.Errorf("%d queries to X and %d to A, expecting exactly 1 each", x, a)
+	}
+	for i, w := range writers {
+		if len(w.msgs) != 1 {
+			t.Errorf("query %d got %d answers", i, len(w.msgs))
+			continue
+		}
+		if m := w.msgs[0]; m.Id != uint16(i) || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+			t.Errorf("query %d got unexpected answer %v", i, m)
+		}
+		e := getECS(w.msgs[0])
+		switch {
+		case i%2 == 1 && w.msgs[0].IsEdns0() != nil:
+			t.Errorf("query %d without EDNS got OPT", i)
+		case i%2 == 0 && (e == nil || !e.Address.Equal(net.IPv4(10, 0, byte(i), 0))):
+			t.Errorf("query %d got ECS of another %v", i, e)
+		case i%2 == 0 && e.SourceScope != 0:
+			t.Errorf("query %d got ECS scope %d of an answer for another subnet", i, e.SourceScope)
+		}
+	}
+
+	// with the client's subnet sent to A, one probe per subnet
+	parseECS("A=client")
+	defer func() { ecs = map[int]ecsSetting{} }()
+	setTestProfile()
+	atomic.StoreInt32(&nX, 0)
+	atomic.StoreInt32(&nA, 0)
+	subnets := []net.IP{net.IPv4(198, 51, 100, 0), net.IPv4(203, 0, 113, 0)}
+	for i := range writers {
+		writers[i] = &testWriter{}
+		wg.Add(1)
+		go func(w *testWriter, subnet net.IP) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("example.net.", dns.TypeA)
+			req.SetEdns0(ednsUDPSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, newSubnet(subnet, 24))
+			handle(w, req)
+		}(writers[i], subnets[i%2])
+	}
+	wg.Wait()
+	if a := atomic.LoadInt32(&nA); a != 2 {
+		t.Errorf("%d queries to A, expecting 1 for each subnet", a)
+	}
+	for i, w := range writers {
+		if len(w.msgs) != 1 {
+			t.Errorf("query %d got %d answers", i, len(w.msgs))
+		} else if e := getECS(w.msgs[0]); e == nil || !e.Address.Equal(subnets[i%2]) {
+			t.Errorf("query %d got ECS of another %v", i, e)
+		}
+	}
+}
+
+// default profile only, with A's set 1.0.0.0/8
+func setTestProfile() {
+	defaultProfile = &profile{
+		name:  "default",
+		links: []int{0},
+		ipMap: ip4map.New(2, 24),
+		block: newDomainSet(),
+		cache: newMapCache(),
+		learn: newLearner(),
+		hits:  newHitCounter(),
+	}
+	defaultProfile.ipMap.SetStr("1.0.0.0/8", ipA)
+	profiles = []*profile{}
+}
+
+func TestBackoff(t *testing.T) {
+	var nA int32
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{
+		{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 2.2.2.2")
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		})},
+		{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(&nA, 1)
+			handleWith(w, req, dns.RcodeServerFailure)
+		})},
+	})
+	setTestProfile()
+	*backoff = 200 * time.Millisecond
+	defer func() { *backoff = 0 }()
+
+	query := func() *dns.Msg {
+		w := &testWriter{}
+		req := new(dns.Msg)
+		req.SetQuestion("flaky.example.", dns.TypeA)
+		handle(w, req)
+		if len(w.msgs) != 1 {
+			t.Fatalf("got %d answers", len(w.msgs))
+		}
+		return w.msgs[0]
+	}
+	for i := 0; i < 3; i++ {
+		if m := query(); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "2.2.2.2" {
+			t.Errorf("query %d got unexpected answer %v", i, m)
+		}
+	}
+	if n := atomic.LoadInt32(&nA); n != 1 {
+		t.Errorf("A queried %d times during backoff, expecting 1", n)
+	}
+	if dec := defaultProfile.cache.get("flaky.example."); dec != noDecision {
+		t.Errorf("decision %s cached with A failing", decisionToStr(dec))
+	}
+	time.Sleep(*backoff)
+	query()
+	if n := atomic.LoadInt32(&nA); n != 2 {
+		t.Errorf("A queried %d times after backoff, expecting 2", n)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	names = []string{"X"}
+	upstream = testUpstreams([][]string{{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		handleWith(w, req, dns.RcodeSuccess)
+	})}})
+	*limitWait = 50 * time.Millisecond
+	defer func() {
+		limits = map[int]*upstreamLimit{}
+		*limitWait = time.Second
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	limits = map[int]*upstreamLimit{}
+	parseLimits("X=1", "")
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := exchange(req.Copy(), upstreamX)
+			errs <- err
+		}()
+	}
+	if err1, err2 := <-errs, <-errs; !errors.Is(err1, errOverLimit) || err2 != nil {
+		t.Errorf("expecting the first to be over limit and the second to succeed, got %v and %v", err1, err2)
+	}
+	health.Lock()
+	if h := health.m[upstream[0].get()[0]]; h != nil && h.failures > 0 {
+		t.Errorf("over limit counted as %d failures", h.failures)
+	}
+	health.Unlock()
+
+	limits = map[int]*upstreamLimit{}
+	parseLimits("", "X=2")
+	for i := 0; i < 3; i++ {
+		release, err := limitAcquire(upstreamX)
+		if i < 2 && err != nil {
+			t.Errorf("query %d within the burst: %v", i, err)
+		}
+		if i == 2 && !errors.Is(err, errOverLimit) {
+			t.Errorf("query %d over the burst: %v", i, err)
+		}
+		if err == nil {
+			release()
+		}
+	}
+}
+
+func TestOverload(t *testing.T) {
+	names = []string{"X"}
+	setTestProfile()
+	parseOverload(1, 1, "SERVFAIL")
+	defer func() {
+		querySlots, cacheWriteSlots, shedRcode = nil, nil, dns.RcodeRefused
+	}()
+
+	// one query in flight already
+	if !queryAdmit() {
+		t.Fatal("first query shed")
+	}
+	shed := queriesShed.get()
+	w := &testWriter{}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	handle(w, req)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeServerFailure {
+		t.Errorf("expecting SERVFAIL for a shed query, got %v", w.msgs)
+	}
+	if queriesShed.get() != shed+1 {
+		t.Error("shed query not counted")
+	}
+	queryDone()
+
+	// one cache write pending already
+	cacheWriteSlots <- struct{}{}
+	c := newMapCache()
+	cacheWrite(c, "example.com.", upstreamX, nil, time.Minute)
+	<-cacheWriteSlots
+	time.Sleep(10 * time.Millisecond)
+	if v := c.get("example.com."); v != noDecision {
+		t.Errorf("cache write over the limit not dropped, got %s", decisionToStr(v))
+	}
+	cacheWrite(c, "example.com.", upstreamX, nil, time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if v := c.get("example.com."); v != upstreamX {
+		t.Errorf("cache write not done, got %s", decisionToStr(v))
+	}
+}
+
+func testUpstreams(groups [][]string) []*upstreamGroup {
+	r := []*upstreamGroup{}
+	for _, addrs := range groups {
+		r = append(r, newUpstreamGroup(addrs))
+	}
+	return r
+}
+
+func TestResolvconf(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "resolv.conf")
+	write := func(s string, mtime time.Time) {
+		if err := os.WriteFile(fn, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fn, mtime, mtime)
+	}
+	now := time.Now()
+	write("nameserver 192.0.2.1\nnameserver 2001:db8::1\n", now)
+	g := parseUpstream(resolvconfPrefix + fn)
+	if s := strings.Join(g.get(), " "); s != "192.0.2.1:53 [2001:db8::1]:53" {
+		t.Errorf("addresses read: %s", s)
+	}
+	if g.reload() {
+		t.Error("reloaded while not modified")
+	}
+	write("search lan\nnameserver 192.0.2.2\n", now.Add(time.Second))
+	if !g.reload() {
+		t.Error("not reloaded while modified")
+	}
+	if s := strings.Join(g.get(), " "); s != "192.0.2.2:53" {
+		t.Errorf("addresses reloaded: %s", s)
+	}
+	// a missing file keeps the last addresses
+	os.Remove(fn)
+	if g.reload() || len(g.get()) != 1 {
+		t.Errorf("addresses after file removed: %v", g.get())
+	}
+}
+
+// a stand-in authoritative server of zone, NS records below zone are delegations, with A records of them as glue
+func testAuthServer(t *testing.T, addr, zone string, n *int32, records ...string) string {
+	rrs := []dns.RR{}
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return startTestServerAt(t, addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(n, 1)
+		q := req.Question[0]
+		res := new(dns.Msg)
+		res.SetReply(req)
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name != zone && dns.IsSubDomain(ns.Hdr.Name, q.Name) {
+				res.Ns = append(res.Ns, ns)
+				for _, glue := range rrs {
+					if a, ok := glue.(*dns.A); ok && a.Hdr.Name == ns.Ns {
+						res.Extra = append(res.Extra, a)
+					}
+				}
+			}
+		}
+		if len(res.Ns) > 0 {
+			w.WriteMsg(res)
+			return
+		}
+		res.Authoritative = true
+		res.Rcode = dns.RcodeNameError
+		for _, rr := range rrs {
+			if rr.Header().Name != q.Name {
+				continue
+			}
+			res.Rcode = dns.RcodeSuccess
+			if t := rr.Header().Rrtype; t == q.Qtype || t == dns.TypeCNAME {
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+		w.WriteMsg(res)
+	})
+}
+
+func TestIterative(t *testing.T) {
+	var nRoot, nTLD, nAuth int32
+	_, port, _ := net.SplitHostPort(testAuthServer(t, "127.0.0.1:0", ".", &nRoot,
+		"test. 3600 IN NS ns.test.",
+		"ns.test. 3600 IN A 127.0.0.2"))
+	// other.test. has no glue
+	testAuthServer(t, "127.0.0.2:"+port, "test.", &nTLD,
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 127.0.0.3",
+		"other.test. 3600 IN NS ns.example.test.",
+		"evil.test. 3600 IN NS ns.evil.test.",
+		"ns.evil.test. 3600 IN A 127.0.0.4",
+		"slow.test. 3600 IN NS ns.slow.test.",
+		"ns.slow.test. 3600 IN A 127.0.0.5",
+		// the first name server doesn't answer
+		"lame.test. 3600 IN NS ns.slow.test.",
+		"lame.test. 3600 IN NS ns.lame.test.",
+		"ns.lame.test. 3600 IN A 127.0.0.6",
+		// glue out of test. pointing to the forger
+		"far.test. 3600 IN NS ns.far.example.",
+		"ns.far.example. 3600 IN A 127.0.0.4")
+	// forges a record of example.test.
+	startTestServerAt(t, "127.0.0.4:"+port, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Authoritative = true
+		for _, r := range []string{req.Question[0].Name + " 60 IN CNAME www.example.test.", "www.example.test. 60 IN A 6.6.6.6"} {
+			rr, _ := dns.NewRR(r)
+			res.Answer = append(res.Answer, rr)
+		}
+		w.WriteMsg(res)
+	})
+	startTestServerAt(t, "127.0.0.5:"+port, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(time.Second)
+		handleWith(w, req, dns.RcodeSuccess)
+	})
+	testAuthServer(t, "127.0.0.3:"+port, "example.test.", &nAuth,
+		"ns.example.test. 3600 IN A 127.0.0.3",
+		"www.example.test. 60 IN A 192.0.2.1",
+		"alias.other.test. 60 IN CNAME www.example.test.")
+	testAuthServer(t, "127.0.0.6:"+port, "lame.test.", new(int32),
+		"www.lame.test. 60 IN A 192.0.2.2")
+	*iterativePort, _ = strconv.Atoi(port)
+	defer func() { *iterativePort = 53 }()
+	hints := filepath.Join(t.TempDir(), "root.hints")
+	os.WriteFile(hints, []byte(". 3600000 NS a.root-servers.net.\na.root-servers.net. 3600000 A 127.0.0.1\n"), 0644)
+	names = []string{"X"}
+	upstream = []*upstreamGroup{parseUpstream("iterative:" + hints)}
+
+	for _, e := range []struct {
+		name  string
+		rcode int
+		ips   string
+	}{
+		{"www.example.test.", dns.RcodeSuccess, "192.0.2.1"},
+		{"alias.other.test.", dns.RcodeSuccess, "192.0.2.1"},
+		{"nx.example.test.", dns.RcodeNameError, ""},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(e.name, dns.TypeA)
+		res, _, err := exchange(req, upstreamX)
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		ips := []string{}
+		for _, ip := range answerIPs(res) {
+			ips = append(ips, ip.String())
+		}
+		if res.Rcode != e.rcode || strings.Join(ips, ",") != e.ips || res.Id != req.Id || !res.RecursionAvailable {
+			t.Errorf("%s: unexpected answer %v", e.name, res)
+		}
+	}
+	// test. and example.test. are cached
+	if n := atomic.LoadInt32(&nRoot); n != 1 {
+		t.Errorf("root queried %d times, expecting 1", n)
+	}
+	if n := atomic.LoadInt32(&nTLD); n != 2 {
+		t.Errorf("test. queried %d times, expecting 2", n)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.evil.test.", dns.TypeA)
+	if res, _, err := exchange(req, upstreamX); err != nil {
+		t.Errorf("www.evil.test.: %v", err)
+	} else if ips := answerIPs(res); len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("www.evil.test.: CNAME target not resolved in its own zone, got %v", res)
+	}
+
+	req.SetQuestion("www.far.test.", dns.TypeA)
+	if res, _, err := exchange(req, upstreamX); err == nil {
+		t.Errorf("www.far.test.: expecting out of zone glue ignored, got %v", res)
+	}
+
+	*iterativeTimeout = 500 * time.Millisecond
+	iterServerTimeout = 100 * time.Millisecond
+	defer func() { *iterativeTimeout, iterServerTimeout = 5*time.Second, 2*time.Second }()
+	req.SetQuestion("www.lame.test.", dns.TypeA)
+	if res, _, err := exchange(req, upstreamX); err != nil {
+		t.Errorf("www.lame.test.: %v", err)
+	} else if ips := answerIPs(res); len(ips) != 1 || ips[0].String() != "192.0.2.2" {
+		t.Errorf("www.lame.test.: unexpected answer %v", res)
+	}
+
+	*iterativeTimeout = 100 * time.Millisecond
+	start := time.Now()
+	req.SetQuestion("www.slow.test.", dns.TypeA)
+	if _, _, err := exchange(req, upstreamX); err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("www.slow.test.: expecting a timeout within the budget, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestAny(t *testing.T) {
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{
+		{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			handleWith(w, req, dns.RcodeRefused)
+		})},
+		{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			n := req.Question[0].Name
+			rr, _ := dns.NewRR(n + " 60 IN A 1.1.1.1")
+			res.Answer = append(res.Answer, rr)
+			if req.Question[0].Qtype == dns.TypeANY {
+				rr, _ = dns.NewRR(n + " 60 IN A 9.9.9.9")
+				res.Answer = append(res.Answer, rr)
+				rr, _ = dns.NewRR(n + " 60 IN TXT \"v=spf1 -all\"")
+				res.Answer = append(res.Answer, rr)
+			}
+			w.WriteMsg(res)
+		})},
+	})
+	setTestProfile()
+	defer func() { anyMode = anyNotImp }()
+	query := func() *dns.Msg {
+		w := &testWriter{}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeANY)
+		handle(w, req)
+		if len(w.msgs) != 1 {
+			t.Fatalf("got %d answers", len(w.msgs))
+		}
+		return w.msgs[0]
+	}
+
+	if m := query(); m.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("expecting NOTIMP by default, got %v", m)
+	}
+	parseAny("hinfo")
+	if m := query(); len(m.Answer) != 1 || m.Answer[0].(*dns.HINFO).Cpu != "RFC8482" {
+		t.Errorf("expecting a synthesized HINFO, got %v", m)
+	}
+	parseAny("forward")
+	m := query()
+	types := []string{}
+	for _, rr := range m.Answer {
+		types = append(types, dns.TypeToString[rr.Header().Rrtype])
+	}
+	if ips := answerIPs(m); len(ips) != 1 || ips[0].String() != "1.1.1.1" || strings.Join(types, ",") != "A,TXT" {
+		t.Errorf("expecting the out of set A record filtered, got %v", m)
+	}
+}
+
+func TestLearn(t *testing.T) {
+	names = []string{"X", "A"}
+	*learnN = 2
+	defer func() { *learnN, *learnTTL = 0, 24*time.Hour }()
+	l := newLearner()
+
+	l.learn("a.example.com.", upstreamA)
+	if dec := l.lookup("c.example.com."); dec != noDecision {
+		t.Errorf("rule learned from 1 subdomain: %s", decisionToStr(dec))
+	}
+	l.learn("b.example.com.", upstreamA)
+	if dec := l.lookup("c.example.com."); dec != upstreamA {
+		t.Errorf("rule not learned from 2 subdomains, got %s", decisionToStr(dec))
+	}
+	if dec := l.lookup("C.Example.COM."); dec != upstreamA {
+		t.Errorf("rule not matched in mixed case, got %s", decisionToStr(dec))
+	}
+	l.learn("d.example.com.", upstreamX)
+	if dec := l.lookup("c.example.com."); dec != noDecision {
+		t.Errorf("rule not dropped on contradiction, got %s", decisionToStr(dec))
+	}
+
+	// never learn public suffixes
+	l.learn("foo.github.io.", upstreamA)
+	l.learn("bar.github.io.", upstreamA)
+	if dec := l.lookup("baz.github.io."); dec != noDecision {
+		t.Errorf("rule learned for a public suffix: %s", decisionToStr(dec))
+	}
+
+	*learnTTL = time.Millisecond
+	l.learn("a.example.net.", upstreamA)
+	l.learn("b.example.net.", upstreamA)
+	time.Sleep(2 * time.Millisecond)
+	if dec := l.lookup("c.example.net."); dec != noDecision {
+		t.Errorf("rule not expired: %s", decisionToStr(dec))
+	}
+	*learnTTL = time.Hour
+
+	// CHAOS forget
+	setTestProfile()
+	p := defaultProfile
+	p.learn.learn("a.example.org.", upstreamA)
+	p.learn.learn("b.example.org.", upstreamA)
+	w := &testWriter{}
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.forget.diverge.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	handleCHAOS(p, w, req)
+	if len(w.msgs) != 1 || w.msgs[0].Answer[0].(*dns.TXT).Txt[0] != "deleted example.org." {
+		t.Errorf("unexpected answer to forget: %v", w.msgs)
+	}
+	if dec := p.learn.lookup("c.example.org."); dec != noDecision {
+		t.Errorf("rule not forgotten: %s", decisionToStr(dec))
+	}
+
+	// verification probing finds it went to X
+	answer := func(a string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + a)
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		}
+	}
+	upstream = testUpstreams([][]string{{startTestServer(t, answer("2.2.2.2"))}, {startTestServer(t, answer("2.2.2.2"))}})
+	p.learn.learn("a.example.org.", upstreamA)
+	p.learn.learn("b.example.org.", upstreamA)
+	learnVerifyName(p, "c.example.org.")
+	if dec := p.learn.lookup("d.example.org."); dec != noDecision {
+		t.Errorf("rule not dropped by verification: %s", decisionToStr(dec))
+	}
+}
+
+// map cache with TTL
+type ttlCache struct {
+	*mapCache
+	ttls map[string]time.Duration
+}
+
+func (tc *ttlCache) ttl(k string) time.Duration {
+	return tc.ttls[k]
+}
+
+func TestRefresh(t *testing.T) {
+	var nA int32
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{
+		{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			handleWith(w, req, dns.RcodeRefused)
+		})},
+		{startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(&nA, 1)
+			res := new(dns.Msg)
+			res.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.1.1.1")
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		})},
+	})
+	*refreshInterval = time.Hour
+	defer func() { *refreshInterval = 0 }()
+	setTestProfile()
+	guest := &profile{name: "guest", links: []int{0}, ipMap: defaultProfile.ipMap, block: newDomainSet(),
+		learn: newLearner(), hits: newHitCounter()}
+	for _, p := range []*profile{defaultProfile, guest} {
+		tc := &ttlCache{newMapCache(), map[string]time.Duration{}}
+		p.cache = tc
+		for _, name := range []string{"a.example.", "b.example.", "c.example.", "far.example."} {
+			tc.set(name, upstreamX, nil, 0)
+			tc.ttls[name] = time.Minute
+			p.hits.hit(name)
+			p.hits.hit(name)
+		}
+		tc.ttls["far.example."] = 10 * time.Hour
+		// not popular enough
+		p.hits.hit("once.example.")
+	}
+
+	refreshed0, changed0 := refreshed.get(), refreshedChanged.get()
+	budget := 2
+	refreshRound(defaultProfile, &budget)
+	refreshRound(guest, &budget)
+	if n := refreshed.get() - refreshed0; n != 2 || budget != 0 {
+		t.Errorf("%d names refreshed, %d left in budget, expecting 2 and 0", n, budget)
+	}
+	if n := atomic.LoadInt32(&nA); n != 2 {
+		t.Errorf("A queried %d times, expecting 2", n)
+	}
+	if n := refreshedChanged.get() - changed0; n != 2 {
+		t.Errorf("%d refreshed names changed, expecting 2", n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	changed := 0
+	for _, name := range []string{"a.example.", "b.example.", "c.example.", "far.example."} {
+		if defaultProfile.cache.get(name) == upstreamA {
+			changed++
+			if name == "far.example." {
+				t.Error("far.example. refreshed ahead of -refresh-ahead")
+			}
+		}
+		if guest.cache.get(name) != upstreamX {
+			t.Errorf("%s of guest refreshed beyond the budget", name)
+		}
+	}
+	if changed != 2 {
+		t.Errorf("%d cache entries updated, expecting 2", changed)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	*hedge = 200 * time.Millisecond
+	defer func() { *hedge = 0 }()
+	names = []string{"X", "A"}
+	// the time X is queried, compared to when the probe starts
+	xAt := make(chan time.Time, 1)
+	x := startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		xAt <- time.Now()
+		handleWith(w, req, dns.RcodeSuccess)
+	})
+	a := func(delay time.Duration, rcode int) string {
+		return startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			time.Sleep(delay)
+			res := new(dns.Msg)
+			res.SetRcode(req, rcode)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.1.1.1")
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		})
+	}
+	probe := func(a string) time.Time {
+		upstream = testUpstreams([][]string{{x}, {a}})
+		setTestProfile()
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		start := time.Now()
+		handleDivergeTypeA(defaultProfile, &testWriter{}, req)
+		return start
+	}
+
+	// a fast match, X is never queried
+	saved := probesXSkip.get()
+	probe(a(0, dns.RcodeSuccess))
+	select {
+	case <-xAt:
+		t.Error("X queried while A matched in time")
+	case <-time.After(*hedge + 100*time.Millisecond):
+	}
+	if probesXSkip.get() != saved+1 {
+		t.Error("saved X query not counted")
+	}
+
+	// a slow A, X is queried after the delay
+	start := probe(a(400*time.Millisecond, dns.RcodeSuccess))
+	if d := (<-xAt).Sub(start); d < *hedge || d > *hedge+150*time.Millisecond {
+		t.Errorf("X queried after %v with a slow A, expecting %v", d, *hedge)
+	}
+
+	// A fails, X is queried right away
+	start = probe(a(0, dns.RcodeServerFailure))
+	if d := (<-xAt).Sub(start); d > 100*time.Millisecond {
+		t.Errorf("X queried after %v with A failing, expecting right away", d)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	answer := func(a string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			res := new(dns.Msg)
+			res.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + a)
+			res.Answer = append(res.Answer, rr)
+			w.WriteMsg(res)
+		}
+	}
+	names = []string{"X", "A"}
+	upstream = testUpstreams([][]string{{startTestServer(t, answer("1.1.1.1"))}, {startTestServer(t, answer("5.5.5.5"))}})
+	setTestProfile()
+	auditReport.findings, auditReport.next = nil, 0
+
+	auditName(defaultProfile, "example.com.", upstreamA)
+	r := auditInfo()
+	expected := []string{
+		"example.com. X answered 1.1.1.1 which is in A's set",
+		"example.com. A answered 5.5.5.5 which is in no set",
+		"example.com. decision would change from A to X",
+	}
+	if len(r) != len(expected)+1 || !strings.HasPrefix(r[0], "audited ") {
+		t.Fatalf("unexpected audit report: %q", r)
+	}
+	for i, f := range expected {
+		if r[i+1] != f {
+			t.Errorf("finding %d: %q, expecting %q", i, r[i+1], f)
+		}
+	}
+}
+
+func TestEtld1(t *testing.T) {
+	names = []string{"X", "A"}
+	*etld1 = true
+	etld1Exclude = newDomainSet("cdn.example.net.")
+	defer func() { *etld1, etld1Exclude = false, newDomainSet() }()
+	for _, e := range []struct {
+		name string
+		k    string
+		ok   bool
+	}{
+		{"www.example.com.", "*.example.com.", true},
+		{"a.b.example.co.uk.", "*.example.co.uk.", true},
+		// a multi-label public suffix
+		{"foo.github.io.", "*.foo.github.io.", true},
+		{"a.foo.github.io.", "*.foo.github.io.", true},
+		{"img.cdn.example.net.", "", false},
+		{"com.", "", false},
+	} {
+		if k, ok := registrableKey(e.name); k != e.k || ok != e.ok {
+			t.Errorf("registrableKey(%s) = %s, %v, expecting %s, %v", e.name, k, ok, e.k, e.ok)
+		}
+	}
+
+	setTestProfile()
+	p := defaultProfile
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	res := new(dns.Msg)
+	res.SetReply(req)
+	rr, _ := dns.NewRR("www.example.com. 60 IN A 1.1.1.1")
+	res.Answer = append(res.Answer, rr)
+	cacheSave(p, req, res, upstreamA, nil)
+	p.cache.set("*.example.net.", upstreamA, nil, time.Hour)
+	// cache writes are in background
+	time.Sleep(10 * time.Millisecond)
+	for _, e := range []struct {
+		name string
+		dec  int
+	}{
+		{"new.example.com.", upstreamA},
+		{"www.example.net.", upstreamA},
+		{"img.cdn.example.net.", noDecision},
+		{"www.example.org.", noDecision},
+	} {
+		if dec := cacheLookup(p, e.name); dec != e.dec {
+			t.Errorf("cacheLookup(%s) = %s, expecting %s", e.name, decisionToStr(dec), decisionToStr(e.dec))
+		}
+	}
+}
+
 func TestRedisCache(t *testing.T) {
 	c := newCache("tcp", ":6379", 3)
-	c.set("test_a", 1, 1*time.Second)
+	c.set("test_a", 1, nil, 1*time.Second)
 	t.Log(c.get("test_a"))
 	t.Log(c.get("test_b"))
 	time.Sleep(2 * time.Second)
@@ -78,3 +1423,35 @@ func TestGo(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 }
+
+// records messages written, for testing
+type testWriter struct {
+	dns.ResponseWriter
+	addr net.Addr
+	msgs []*dns.Msg
+}
+
+func (tw *testWriter) RemoteAddr() net.Addr {
+	return tw.addr
+}
+
+func (tw *testWriter) WriteMsg(m *dns.Msg) error {
+	tw.msgs = append(tw.msgs, m)
+	return nil
+}
+
+// start a DNS server on a random local UDP port, returns its address
+func startTestServer(t *testing.T, h dns.HandlerFunc) string {
+	return startTestServerAt(t, "127.0.0.1:0", h)
+}
+
+func startTestServerAt(t *testing.T, addr string, h dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: h}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
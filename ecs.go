@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet, per upstream, like -ecs "A=203.0.113.0/24,B=client,X=strip"
+
+const ednsUDPSize = 1232
+
+const (
+	// a fixed subnet
+	ecsFixed = iota
+	// client's own subnet, truncated to /24 (or /56 for IPv6)
+	ecsClient
+	// strip ECS from queries
+	ecsStrip
+)
+
+type ecsSetting struct {
+	mode   int
+	subnet *dns.EDNS0_SUBNET
+}
+
+// keyed by decision, queries are forwarded as is if omitted
+var ecs = map[int]ecsSetting{}
+
+func parseECS(s string) {
+	for dec, vs := range parsePerUpstream("ecs", s) {
+		switch v := vs[len(vs)-1]; v {
+		case "client":
+			ecs[dec] = ecsSetting{mode: ecsClient}
+		case "strip":
+			ecs[dec] = ecsSetting{mode: ecsStrip}
+		default:
+			_, n, err := net.ParseCIDR(v)
+			if err != nil {
+				log.Fatalf("invalid -ecs subnet for %s: %s", decisionToStr(dec), v)
+			}
+			ones, _ := n.Mask.Size()
+			ecs[dec] = ecsSetting{ecsFixed, newSubnet(n.IP, ones)}
+		}
+	}
+}
+
+func newSubnet(ip net.IP, bits int) *dns.EDNS0_SUBNET {
+	o := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(bits)}
+	if ip4 := ip.To4(); ip4 != nil {
+		o.Family = 1
+		o.Address = ip4.Mask(net.CIDRMask(bits, 32))
+	} else {
+		o.Family = 2
+		o.Address = ip.Mask(net.CIDRMask(bits, 128))
+	}
+	return o
+}
+
+func getECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func clientIP(w dns.ResponseWriter) net.IP {
+	if w == nil {
+		return nil
+	}
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func clientSubnet(m *dns.Msg, client net.IP) *dns.EDNS0_SUBNET {
+	ip := client
+	// no longer than the client sent, RFC 7871 7.1.1
+	sent := 0
+	// prefer the one sent by client, in case we're behind another forwarder
+	if e := getECS(m); e != nil {
+		// source prefix 0 means the client doesn't want it, RFC 7871 7.1.2
+		if e.SourceNetmask == 0 {
+			return nil
+		}
+		ip = e.Address
+		sent = int(e.SourceNetmask)
+	}
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	limit := 24
+	if ip.To4() == nil {
+		limit = 56
+	}
+	if sent > 0 && sent < limit {
+		limit = sent
+	}
+	return newSubnet(ip, limit)
+}
+
+// apply the ECS setting of upstream dec to a copy of m
+func withECS(m *dns.Msg, dec int, client net.IP) *dns.Msg {
+	s, ok := ecs[dec]
+	if !ok {
+		return m
+	}
+	var o *dns.EDNS0_SUBNET
+	switch s.mode {
+	case ecsFixed:
+		o = s.subnet
+	case ecsClient:
+		o = clientSubnet(m, client)
+	}
+	if o == nil && getECS(m) == nil {
+		return m
+	}
+	q := m.Copy()
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(ednsUDPSize, false)
+		opt = q.IsEdns0()
+	}
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, eo := range opt.Option {
+		if _, ok := eo.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, eo)
+		}
+	}
+	if o != nil {
+		options = append(options, o)
+	}
+	opt.Option = options
+	return q
+}
+
+// undo in reply r what withECS did to m, so the client gets what it asked for
+func fixECSReply(m, r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	if m.IsEdns0() == nil {
+		extra := make([]dns.RR, 0, len(r.Extra))
+		for _, rr := range r.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		r.Extra = extra
+		return
+	}
+	var scope uint8
+	options := make([]dns.EDNS0, 0, len(opt.Option))
+	for _, eo := range opt.Option {
+		if e, ok := eo.(*dns.EDNS0_SUBNET); ok {
+			scope = e.SourceScope
+		} else {
+			options = append(options, eo)
+		}
+	}
+	if e := getECS(m); e != nil {
+		echo := *e
+		if scope > echo.SourceNetmask {
+			scope = echo.SourceNetmask
+		}
+		echo.SourceScope = scope
+		options = append(options, &echo)
+	}
+	opt.Option = options
+}
+
+// exchange with ECS setting of upstream dec applied
+func exchangeECS(m *dns.Msg, dec int, client net.IP) (*dns.Msg, time.Duration, error) {
+	q := withECS(m, dec, client)
+	r, rtt, err := exchange(q, dec)
+	if err == nil && q != m {
+		fixECSReply(m, r)
+	}
+	return r, rtt, err
+}
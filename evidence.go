@@ -0,0 +1,127 @@
+package main
+
+import (
+	"diverge/ip4map"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// evidence behind a decision, A records answered by each upstream, indexed like upstream,
+// nil if an upstream was not queried (or not waited for),
+// so decisions can be reclassified offline when IP lists are reloaded
+
+type evidence [][]uint32
+
+func (ev evidence) addAnswer(i int, m *dns.Msg) {
+	ips := []uint32{}
+	for _, ip := range answerIPs(m) {
+		if u, ok := ip4map.IPToUint32(ip); ok {
+			ips = append(ips, u)
+		}
+	}
+	ev[i] = ips
+}
+
+// like "|1.1.1.1,1.0.0.1|-|", "-" for unknown, empty for no A records
+func (ev evidence) encode() string {
+	if ev == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, ips := range ev {
+		b.WriteByte('|')
+		if ips == nil {
+			b.WriteByte('-')
+			continue
+		}
+		for j, ip := range ips {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(ip4map.Uint32ToIPStr(ip))
+		}
+	}
+	return b.String()
+}
+
+func decodeEvidence(s string) evidence {
+	fields := strings.Split(s, "|")[1:]
+	ev := make(evidence, len(fields))
+	for i, f := range fields {
+		if f == "-" {
+			continue
+		}
+		ev[i] = []uint32{}
+		if f == "" {
+			continue
+		}
+		for _, a := range strings.Split(f, ",") {
+			if u, ok := ip4map.IPStrToUint32(a); ok {
+				ev[i] = append(ev[i], u)
+			}
+		}
+	}
+	return ev
+}
+
+// decide again with current IP sets of profile p, false if it can't be decided offline
+func (ev evidence) classify(p *profile) (int, bool) {
+	if len(ev) != len(upstream) {
+		return noDecision, false
+	}
+	for _, i := range p.links {
+		ips := ev[i+1]
+		if ips == nil {
+			return noDecision, false
+		}
+		v := i + ipA
+		nIn := 0
+		for _, ip := range ips {
+			if inSet(p, *ip4map.Uint32ToIP(ip), v) {
+				nIn++
+			}
+		}
+		if dec := i + upstreamA; policyMatch(dec, nIn, len(ips)-nIn) {
+			return dec, true
+		}
+	}
+	return upstreamX, true
+}
+
+func reclassifyCache() {
+	reclassifyProfile(defaultProfile)
+	for _, p := range profiles {
+		reclassifyProfile(p)
+	}
+}
+
+// reclassify cached decisions after IP lists are reloaded,
+// those can't be decided offline are deleted to be probed again
+func reclassifyProfile(p *profile) {
+	var total, changed, reprobe, noEvidence int
+	p.cache.scan(func(k string, v int, ev evidence) {
+		// keys of other profiles
+		if p == defaultProfile && strings.IndexByte(k, '/') != -1 {
+			return
+		}
+		total++
+		if ev == nil {
+			noEvidence++
+			return
+		}
+		dec, ok := ev.classify(p)
+		switch {
+		case !ok:
+			reprobe++
+			p.cache.del(k)
+		case dec != v:
+			changed++
+			log.Printf("reclassify %s %s: %s -> %s", p.name, k, decisionToStr(v), decisionToStr(dec))
+			p.cache.update(k, dec, ev)
+		}
+	})
+	log.Printf("reclassified %d decisions of profile %s: %d changed, %d to be probed again, %d without evidence",
+		total, p.name, changed, reprobe, noEvidence)
+}
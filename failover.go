@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// automatic link failover, with -failover-after, when every address of an upstream has been down for that long,
+// names decided to it are served through its fallback (X by default, see -failover) instead,
+// without touching the stored decisions, and switched back once it recovers
+
+// keyed by decision
+var failoverTo = map[int]int{}
+
+var failedOver = struct {
+	sync.Mutex
+	m map[int]bool
+}{m: map[int]bool{}}
+
+var (
+	failovers       = newCounter("failovers")
+	failoverQueries = newCounter("failover-queries")
+)
+
+func parseFailover(s string) {
+	for dec, fs := range parsePerUpstream("failover", s) {
+		to := nameToDecision(fs[len(fs)-1])
+		if to == noDecision || to == dec {
+			log.Fatalf("invalid -failover fallback for %s: %s", decisionToStr(dec), fs[len(fs)-1])
+		}
+		failoverTo[dec] = to
+	}
+}
+
+// since when every address of upstream dec is down
+func linkDownSince(dec int) (time.Time, bool) {
+	health.Lock()
+	defer health.Unlock()
+	var since time.Time
+	// no addresses to tell
+	if upstream[dec-upstreamX].iter != nil {
+		return since, false
+	}
+	for _, addr := range upstream[dec-upstreamX].get() {
+		h := health.m[addr]
+		if h == nil || !h.open {
+			return since, false
+		}
+		if h.since.After(since) {
+			since = h.since
+		}
+	}
+	return since, true
+}
+
+func linkFailedOver(dec int) bool {
+	since, down := linkDownSince(dec)
+	down = down && time.Since(since) >= *failoverAfter
+	failedOver.Lock()
+	defer failedOver.Unlock()
+	if down != failedOver.m[dec] {
+		failedOver.m[dec] = down
+		if down {
+			failovers.inc()
+			log.Printf("link %s down for %v, failing over", decisionToStr(dec), time.Since(since).Round(time.Second))
+		} else {
+			log.Printf("link %s recovered, switching back", decisionToStr(dec))
+		}
+	}
+	return down
+}
+
+// the upstream to serve names decided to dec
+func failoverOf(dec int) int {
+	if *failoverAfter <= 0 || *breakerFailures <= 0 {
+		return dec
+	}
+	to := dec
+	// follow the chain in case the fallback is down too
+	for i := 0; i < len(upstream) && linkFailedOver(to); i++ {
+		next, ok := failoverTo[to]
+		if !ok {
+			next = upstreamX
+		}
+		if next == to {
+			break
+		}
+		to = next
+	}
+	if to != dec {
+		failoverQueries.inc()
+	}
+	return to
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// in-flight deduplication of probes, like singleflight,
+// concurrent identical queries are answered by one probe
+
+type flightKey struct {
+	profile string
+	name    string
+	qtype   uint16
+	// the subnet sent upstream, if answers are tailored to it
+	subnet string
+}
+
+type flight struct {
+	wg sync.WaitGroup
+	// nil if nothing was written
+	res *dns.Msg
+}
+
+var flights = struct {
+	sync.Mutex
+	m map[flightKey]*flight
+}{m: map[flightKey]*flight{}}
+
+var coalesced = newCounter("coalesced")
+
+// records the answer for the waiters
+type flightWriter struct {
+	dns.ResponseWriter
+	f *flight
+}
+
+func (fw *flightWriter) WriteMsg(m *dns.Msg) error {
+	fw.f.res = m
+	return fw.ResponseWriter.WriteMsg(m)
+}
+
+// the client's own subnet if any upstream probed for p sends it, see -ecs client
+func flightSubnet(p *profile, w dns.ResponseWriter, req *dns.Msg) string {
+	for dec, s := range ecs {
+		if s.mode == ecsClient && p.uses(dec) {
+			if o := clientSubnet(req, clientIP(w)); o != nil {
+				return o.String()
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// probe with fn, or wait for the identical one in flight
+func coalesce(p *profile, w dns.ResponseWriter, req *dns.Msg, fn func(w dns.ResponseWriter)) {
+	q := &req.Question[0]
+	k := flightKey{p.name, dns.CanonicalName(q.Name), q.Qtype, flightSubnet(p, w, req)}
+	flights.Lock()
+	if f, in := flights.m[k]; in {
+		flights.Unlock()
+		coalesced.inc()
+		log.Printf("\twaiting for the same query in flight: %s %s", q.Name, dns.TypeToString[q.Qtype])
+		f.wg.Wait()
+		if f.res == nil {
+			handleWith(w, req, dns.RcodeServerFailure)
+			return
+		}
+		res := f.res.Copy()
+		res.Id = req.Id
+		res.Question = req.Question
+		// OPT of this client's own, not the first one's
+		if req.IsEdns0() != nil && res.IsEdns0() == nil {
+			res.SetEdns0(ednsUDPSize, false)
+		}
+		fixECSReply(req, res)
+		// not tailored to this client's subnet
+		if e := getECS(res); e != nil && k.subnet == "" {
+			e.SourceScope = 0
+		}
+		w.WriteMsg(res)
+		return
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	flights.m[k] = f
+	flights.Unlock()
+
+	defer func() {
+		flights.Lock()
+		delete(flights.m, k)
+		flights.Unlock()
+		f.wg.Done()
+	}()
+	fn(&flightWriter{w, f})
+}
@@ -5,11 +5,11 @@ go 1.17
 require (
 	github.com/gomodule/redigo v1.8.8
 	github.com/miekg/dns v1.1.47
+	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 )
 
 require (
 	golang.org/x/mod v0.5.1 // indirect
-	golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect
 	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
 	golang.org/x/tools v0.1.9 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream address health, tracked passively by exchange() and actively by -health-interval probes,
+// after -breaker consecutive failures the circuit breaker opens and the address is skipped,
+// one query is let through every -breaker-cooldown to see if it recovered
+
+type addrHealth struct {
+	// consecutive failures
+	failures int
+	open     bool
+	since    time.Time
+	retryAt  time.Time
+	// smoothed RTT, 0 if never measured
+	srtt time.Duration
+}
+
+var health = struct {
+	sync.Mutex
+	m map[string]*addrHealth
+}{m: map[string]*addrHealth{}}
+
+var breakerOpened = newCounter("breaker-opened")
+
+// caller should hold the lock
+func healthOf(addr string) *addrHealth {
+	h := health.m[addr]
+	if h == nil {
+		h = &addrHealth{}
+		health.m[addr] = h
+	}
+	return h
+}
+
+// false if the breaker is open, let one through every cooldown
+func healthAvailable(addr string) bool {
+	if *breakerFailures <= 0 {
+		return true
+	}
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(addr)
+	if !h.open {
+		return true
+	}
+	now := time.Now()
+	if now.Before(h.retryAt) {
+		return false
+	}
+	h.retryAt = now.Add(*breakerCooldown)
+	return true
+}
+
+func healthReport(dec int, addr string, err error) {
+	if *breakerFailures <= 0 {
+		return
+	}
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(addr)
+	if err == nil {
+		if h.open {
+			log.Printf("upstream %s %s recovered, was down for %v", decisionToStr(dec), addr, time.Since(h.since).Round(time.Second))
+		}
+		h.failures = 0
+		h.open = false
+		return
+	}
+	h.failures++
+	if !h.open && h.failures >= *breakerFailures {
+		breakerOpened.inc()
+		log.Printf("upstream %s %s is down after %d failures: %v", decisionToStr(dec), addr, h.failures, err)
+		h.open = true
+		h.since = time.Now()
+		h.retryAt = h.since.Add(*breakerCooldown)
+	}
+}
+
+// errors count as a timeout
+const rttPenalty = 2 * time.Second
+
+func rttReport(addr string, rtt time.Duration, err error) {
+	if err != nil {
+		rtt = rttPenalty
+	}
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(addr)
+	if h.srtt == 0 {
+		h.srtt = rtt
+	} else {
+		// like TCP, RFC 6298
+		h.srtt = h.srtt - h.srtt/8 + rtt/8
+	}
+}
+
+// with -rtt-order, addresses are tried by smoothed RTT, unmeasured ones first,
+// and occasionally a random one first, so a recovered fast server gets picked again
+func orderAddrs(addrs []string) []string {
+	if !*rttOrder || len(addrs) < 2 {
+		return addrs
+	}
+	ordered := append([]string{}, addrs...)
+	health.Lock()
+	srtt := make(map[string]time.Duration, len(addrs))
+	for _, addr := range addrs {
+		if h := health.m[addr]; h != nil {
+			srtt[addr] = h.srtt
+		}
+	}
+	health.Unlock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return srtt[ordered[i]] < srtt[ordered[j]]
+	})
+	if rand.Float64() < *rttExplore {
+		i := rand.Intn(len(ordered))
+		ordered[0], ordered[i] = ordered[i], ordered[0]
+	}
+	return ordered
+}
+
+func healthLoop() {
+	for range time.Tick(*healthInterval) {
+		for i, g := range upstream {
+			client := newClient(i + upstreamX)
+			for _, addr := range g.get() {
+				req := new(dns.Msg)
+				req.SetQuestion(".", dns.TypeNS)
+				res, rtt, err := client.Exchange(req, addr)
+				if err == nil && failRcodes[res.Rcode] {
+					err = fmt.Errorf("%s from %s", dns.RcodeToString[res.Rcode], addr)
+				}
+				healthReport(i+upstreamX, addr, err)
+				rttReport(addr, rtt, err)
+			}
+		}
+	}
+}
+
+func healthInfo() []string {
+	health.Lock()
+	defer health.Unlock()
+	r := []string{}
+	for i, g := range upstream {
+		for _, addr := range g.get() {
+			s := decisionToStr(i+upstreamX) + " " + addr
+			h := health.m[addr]
+			switch {
+			case h == nil:
+				s += " unknown"
+			case h.open:
+				s += fmt.Sprintf(" down for %v, %d failures", time.Since(h.since).Round(time.Second), h.failures)
+			default:
+				s += fmt.Sprintf(" up, %d failures", h.failures)
+			}
+			if h != nil && h.srtt != 0 {
+				s += fmt.Sprintf(", srtt %v", h.srtt.Round(time.Millisecond))
+			}
+			r = append(r, s)
+		}
+	}
+	return r
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// built-in iterative resolver as an upstream, like
+//	iterative
+//	iterative:/etc/bind/root.hints
+// resolves from the root servers, or the ones in a root hints file, with its own delegation cache,
+// queries go out from -bind of that upstream, to port -iterative-port of the name servers,
+// each client query is resolved within -iterative-timeout
+
+const iterativePrefix = "iterative"
+
+const (
+	iterMaxReferrals   = 16
+	iterMaxDepth       = 8
+	iterMaxDelegations = 10000
+)
+
+// for each name server, so a lame one leaves time for the others
+var iterServerTimeout = 2 * time.Second
+
+// IPv4 addresses of a to m.root-servers.net.
+var rootServers = []string{
+	"198.41.0.4",
+	"170.247.170.2",
+	"192.33.4.12",
+	"199.7.91.13",
+	"192.203.230.10",
+	"192.5.5.241",
+	"192.112.36.4",
+	"198.97.190.53",
+	"192.36.148.17",
+	"192.58.128.30",
+	"193.0.14.129",
+	"199.7.83.42",
+	"202.12.27.33",
+}
+
+var iterQueries = newCounter("iterative-queries")
+
+var errIterTimeout = errors.New("iterative resolution timed out")
+
+// one client query being resolved
+type iterTask struct {
+	dec int
+	// for the whole resolution, across referrals and name servers
+	deadline time.Time
+}
+
+// for the next name server, 0 if the time is up
+func (t *iterTask) timeout() time.Duration {
+	left := time.Until(t.deadline)
+	if left < 0 {
+		return 0
+	}
+	if left > iterServerTimeout {
+		return iterServerTimeout
+	}
+	return left
+}
+
+type delegation struct {
+	// without port
+	addrs  []string
+	expire time.Time
+}
+
+type iterResolver struct {
+	roots []string
+	sync.Mutex
+	// keyed by zone in lower case
+	delegations map[string]delegation
+}
+
+func newIterResolver(hints string) *iterResolver {
+	r := &iterResolver{roots: rootServers, delegations: map[string]delegation{}}
+	if hints != "" {
+		r.roots = loadRootHints(hints)
+	}
+	return r
+}
+
+// addresses of A and AAAA records in a root hints file
+func loadRootHints(fn string) []string {
+	f, err := os.Open(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	addrs := []string{}
+	zp := dns.NewZoneParser(f, ".", fn)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	if err := zp.Err(); err != nil {
+		log.Fatalf("invalid root hints %s: %v", fn, err)
+	}
+	if len(addrs) == 0 {
+		log.Fatalf("no root server address in %s", fn)
+	}
+	return addrs
+}
+
+// the closest enclosing zone of name with its name servers known
+func (r *iterResolver) closest(name string) (string, []string) {
+	name = strings.ToLower(name)
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	for _, i := range dns.Split(name) {
+		if d, ok := r.delegations[name[i:]]; ok && now.Before(d.expire) {
+			return name[i:], d.addrs
+		}
+	}
+	return ".", r.roots
+}
+
+func (r *iterResolver) delegate(zone string, addrs []string, ttl uint32) {
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	if len(r.delegations) >= iterMaxDelegations {
+		for z, d := range r.delegations {
+			if now.After(d.expire) {
+				delete(r.delegations, z)
+			}
+		}
+		if len(r.delegations) >= iterMaxDelegations {
+			r.delegations = map[string]delegation{}
+		}
+	}
+	r.delegations[strings.ToLower(zone)] = delegation{addrs, now.Add(time.Duration(ttl) * rrTTLUnit)}
+}
+
+func tcpClient(dec int) *dns.Client {
+	client := &dns.Client{Net: "tcp"}
+	if ip, ok := bindAddr[dec]; ok {
+		client.Dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	}
+	return client
+}
+
+// non-recursive query to the first name server answering
+func (r *iterResolver) query(t *iterTask, addrs []string, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(ednsUDPSize, false)
+	client := newClient(t.dec)
+	client.UDPSize = ednsUDPSize
+	err := errors.New("no name server")
+	for _, a := range addrs {
+		timeout := t.timeout()
+		if timeout == 0 {
+			return nil, errIterTimeout
+		}
+		iterQueries.inc()
+		addr := net.JoinHostPort(a, strconv.Itoa(*iterativePort))
+		var res *dns.Msg
+		client.Timeout = timeout
+		res, _, err = client.Exchange(m, addr)
+		if err == nil && res.Truncated {
+			tcp := tcpClient(t.dec)
+			tcp.Timeout = t.timeout()
+			res, _, err = tcp.Exchange(m, addr)
+		}
+		if err != nil {
+			continue
+		}
+		if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%s from %s", dns.RcodeToString[res.Rcode], addr)
+			continue
+		}
+		return res, nil
+	}
+	return nil, err
+}
+
+// a referral from zone to a child zone enclosing name, "" if not
+func referral(res *dns.Msg, zone, name string) (child string, ns []string, ttl uint32) {
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) > 0 {
+		return
+	}
+	for _, rr := range res.Ns {
+		n, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := n.Hdr.Name
+		// only downwards, and towards name
+		if dns.CountLabel(owner) <= dns.CountLabel(zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child == "" {
+			child, ttl = owner, n.Hdr.Ttl
+		} else if !strings.EqualFold(owner, child) {
+			continue
+		}
+		ns = append(ns, n.Ns)
+		if n.Hdr.Ttl < ttl {
+			ttl = n.Hdr.Ttl
+		}
+	}
+	return
+}
+
+// glue, or resolve the name servers if none,
+// glue is only taken for name servers in zone, the one referring
+func (r *iterResolver) nsAddrs(t *iterTask, res *dns.Msg, zone string, ns []string, depth int) []string {
+	addrs := []string{}
+	for _, rr := range res.Extra {
+		if a, ok := rr.(*dns.A); ok && dns.IsSubDomain(zone, a.Hdr.Name) {
+			for _, n := range ns {
+				if strings.EqualFold(a.Hdr.Name, n) {
+					addrs = append(addrs, a.A.String())
+				}
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+	for _, n := range ns {
+		nres, err := r.lookup(t, n, dns.TypeA, depth+1)
+		if err != nil {
+			log.Printf("\titerative: name server %s: %v", n, err)
+			continue
+		}
+		for _, ip := range answerIPs(nres) {
+			addrs = append(addrs, ip.String())
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+func (r *iterResolver) lookup(t *iterTask, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > iterMaxDepth {
+		return nil, fmt.Errorf("%s: too deep", name)
+	}
+	zone, addrs := r.closest(name)
+	for i := 0; i < iterMaxReferrals; i++ {
+		res, err := r.query(t, addrs, name, qtype)
+		if err != nil {
+			return nil, fmt.Errorf("%s at %s: %w", name, zone, err)
+		}
+		child, ns, ttl := referral(res, zone, name)
+		if child == "" {
+			return r.chase(t, res, zone, name, qtype, depth)
+		}
+		addrs = r.nsAddrs(t, res, zone, ns, depth)
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("%s: no address of name servers of %s", name, child)
+		}
+		r.delegate(child, addrs, ttl)
+		zone = child
+	}
+	return nil, fmt.Errorf("%s: too many referrals", name)
+}
+
+// follow a CNAME chain out of zone, the answering zone,
+// records out of zone are not taken from its servers, but resolved
+func (r *iterResolver) chase(t *iterTask, res *dns.Msg, zone, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	answer := make([]dns.RR, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			answer = append(answer, rr)
+		}
+	}
+	res.Answer = answer
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return res, nil
+	}
+	target := name
+	// bounded, in case of a loop
+	for i := 0; i < len(res.Answer); i++ {
+		next := ""
+		for _, rr := range res.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, target) {
+				next = c.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if strings.EqualFold(target, name) {
+		return res, nil
+	}
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, target) {
+			return res, nil
+		}
+	}
+	tres, err := r.lookup(t, target, qtype, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	res.Answer = append(res.Answer, tres.Answer...)
+	res.Ns = tres.Ns
+	res.Rcode = tres.Rcode
+	return res, nil
+}
+
+// answer m like a recursive resolver would
+func (r *iterResolver) resolve(m *dns.Msg, dec int) (*dns.Msg, error) {
+	q := &m.Question[0]
+	res, err := r.lookup(&iterTask{dec, time.Now().Add(*iterativeTimeout)}, q.Name, q.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.RecursionAvailable = true
+	reply.Rcode = res.Rcode
+	reply.Answer = res.Answer
+	if len(reply.Answer) == 0 {
+		// SOA for negative caching
+		reply.Ns = res.Ns
+	}
+	if m.IsEdns0() != nil {
+		reply.SetEdns0(ednsUDPSize, false)
+	}
+	return reply, nil
+}
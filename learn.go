@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// with -learn N, when N distinct subdomains of a parent domain went to the same upstream,
+// the parent is promoted to a learned rule, new subdomains of it will skip probing.
+// learned rules expire after -learn-ttl, and are dropped as soon as a subdomain contradicts them,
+// so a fraction (-learn-verify) of names served by rules are still probed in background, audits count too.
+
+// it's only a hint for learning, so just start over if it grows too large
+const learnMaxParents = 1 << 16
+
+type learnedRule struct {
+	dec    int
+	expire time.Time
+}
+
+type learnCandidate struct {
+	dec  int
+	subs map[string]struct{}
+}
+
+// one per profile
+type learner struct {
+	sync.Mutex
+	rules map[string]learnedRule
+	seen  map[string]*learnCandidate
+}
+
+func newLearner() *learner {
+	return &learner{
+		rules: map[string]learnedRule{},
+		seen:  map[string]*learnCandidate{},
+	}
+}
+
+var (
+	learnedHits     = newCounter("learned-hits")
+	learnedVerified = newCounter("learned-verified")
+)
+
+func parentDomain(name string) (string, bool) {
+	dot := strings.IndexByte(name, '.')
+	if dot == -1 || dot == len(name)-1 {
+		return "", false
+	}
+	return name[dot+1:], true
+}
+
+// caller should hold the lock
+func (learned *learner) ruleOf(name string) (string, learnedRule, bool) {
+	for p, ok := parentDomain(name); ok; p, ok = parentDomain(p) {
+		if r, in := learned.rules[p]; in {
+			if time.Now().After(r.expire) {
+				delete(learned.rules, p)
+				log.Printf("learned rule %s expired", p)
+				continue
+			}
+			return p, r, true
+		}
+	}
+	return "", learnedRule{}, false
+}
+
+// get the decision for name from learned rules
+func (learned *learner) lookup(name string) int {
+	if *learnN <= 0 {
+		return noDecision
+	}
+	learned.Lock()
+	defer learned.Unlock()
+	// rules are in lower case, queries may be in any, like 0x20 randomised
+	p, r, ok := learned.ruleOf(strings.ToLower(name))
+	if !ok {
+		return noDecision
+	}
+	learnedHits.inc()
+	log.Printf("\tdecision %s: %s, from learned rule %s", name, decisionToStr(r.dec), p)
+	return r.dec
+}
+
+// learn from a decision made by probing
+func (learned *learner) learn(name string, dec int) {
+	if *learnN <= 0 {
+		return
+	}
+	name = strings.ToLower(name)
+	learned.Lock()
+	defer learned.Unlock()
+	if p, r, ok := learned.ruleOf(name); ok && r.dec != dec {
+		delete(learned.rules, p)
+		log.Printf("learned rule %s: %s dropped, %s went to %s",
+			p, decisionToStr(r.dec), name, decisionToStr(dec))
+	}
+	p, ok := parentDomain(name)
+	if !ok {
+		return
+	}
+	// never learn public suffixes like "com." or "github.io."
+	if ps, _ := publicsuffix.PublicSuffix(strings.TrimSuffix(p, ".")); ps+"." == p {
+		return
+	}
+	if _, in := learned.rules[p]; in {
+		return
+	}
+	c := learned.seen[p]
+	if c == nil || c.dec != dec {
+		if len(learned.seen) >= learnMaxParents {
+			learned.seen = map[string]*learnCandidate{}
+		}
+		c = &learnCandidate{dec, map[string]struct{}{}}
+		learned.seen[p] = c
+	}
+	c.subs[name] = struct{}{}
+	if len(c.subs) >= *learnN {
+		delete(learned.seen, p)
+		learned.rules[p] = learnedRule{dec, time.Now().Add(*learnTTL)}
+		log.Printf("learned rule %s: %s, from %d subdomains", p, decisionToStr(dec), *learnN)
+	}
+}
+
+func (learned *learner) info() []string {
+	learned.Lock()
+	defer learned.Unlock()
+	r := make([]string, 0, len(learned.rules))
+	now := time.Now()
+	for p, rule := range learned.rules {
+		if now.After(rule.expire) {
+			continue
+		}
+		r = append(r, p+" "+decisionToStr(rule.dec)+", expires in "+rule.expire.Sub(now).Round(time.Second).String())
+	}
+	sort.Strings(r)
+	return r
+}
+
+func (learned *learner) forget(p string) bool {
+	learned.Lock()
+	defer learned.Unlock()
+	if _, in := learned.rules[p]; !in {
+		return false
+	}
+	delete(learned.rules, p)
+	log.Printf("learned rule %s deleted", p)
+	return true
+}
+
+func learnVerifySample() bool {
+	return *learnVerify > 0 && rand.Float64() < *learnVerify
+}
+
+// probe a name served by a learned rule, the rule is dropped by learn() if contradicted
+func learnVerifyName(p *profile, name string) {
+	learnedVerified.inc()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	handleDivergeTypeA(p, nil, req)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// per upstream limits on queries in flight (-inflight) and queries per second (-qps),
+// queries over the limits are queued for up to -limit-wait, then fail with errOverLimit,
+// which is not a failure of the upstream, so not counted by the circuit breaker
+
+var errOverLimit = errors.New("over limit")
+
+var overLimit = newCounter("over-limit")
+
+type upstreamLimit struct {
+	// nil if not limited
+	inflight chan struct{}
+	// 0 if not limited
+	interval time.Duration
+	sync.Mutex
+	// theoretical arrival time of the next query, GCRA with a burst of one second
+	tat time.Time
+}
+
+// keyed by decision
+var limits = map[int]*upstreamLimit{}
+
+func limitOf(dec int) *upstreamLimit {
+	l, ok := limits[dec]
+	if !ok {
+		l = &upstreamLimit{}
+		limits[dec] = l
+	}
+	return l
+}
+
+func parseLimits(inflight, qps string) {
+	for dec, vs := range parsePerUpstream("inflight", inflight) {
+		n, err := strconv.Atoi(vs[len(vs)-1])
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid -inflight for %s: %s", decisionToStr(dec), vs[len(vs)-1])
+		}
+		limitOf(dec).inflight = make(chan struct{}, n)
+	}
+	for dec, vs := range parsePerUpstream("qps", qps) {
+		n, err := strconv.ParseFloat(vs[len(vs)-1], 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid -qps for %s: %s", decisionToStr(dec), vs[len(vs)-1])
+		}
+		limitOf(dec).interval = time.Duration(float64(time.Second) / n)
+	}
+}
+
+// wait for a slot, the returned func releases it
+func limitAcquire(dec int) (func(), error) {
+	l := limits[dec]
+	if l == nil {
+		return func() {}, nil
+	}
+	deadline := time.Now().Add(*limitWait)
+	if l.interval > 0 {
+		now := time.Now()
+		l.Lock()
+		tat := l.tat
+		if tat.Before(now) {
+			tat = now
+		}
+		at := tat.Add(l.interval - time.Second)
+		if at.After(deadline) {
+			l.Unlock()
+			overLimit.inc()
+			return nil, fmt.Errorf("%s %w of %v queries per second", decisionToStr(dec), errOverLimit, float64(time.Second)/float64(l.interval))
+		}
+		l.tat = tat.Add(l.interval)
+		l.Unlock()
+		if at.After(now) {
+			time.Sleep(at.Sub(now))
+		}
+	}
+	if l.inflight == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.inflight <- struct{}{}:
+	default:
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		select {
+		case l.inflight <- struct{}{}:
+		case <-t.C:
+			overLimit.inc()
+			return nil, fmt.Errorf("%s %w of %d queries in flight", decisionToStr(dec), errOverLimit, cap(l.inflight))
+		}
+	}
+	return func() { <-l.inflight }, nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"diverge/ip4map"
 	"flag"
 	"fmt"
 	"log"
@@ -28,15 +27,116 @@ var (
 		"redis database index")
 	flagBlock = flag.String("block", "",
 		"comma seperated list of domain names to be blocked")
+	hedge = flag.Duration("hedge", 0,
+		"hedged probing, query upstream X only if no A-side upstream matched within this delay\n"+
+			"\tor an A-side upstream failed or didn't match, 0 to query all upstreams at once")
+	auditRate = flag.Float64("audit", 0,
+		"fraction of queries to audit, by querying every upstream even on cache hits\n"+
+			"\tanswers contradicting the IP sets are reported via CHAOS \"audit.diverge.\"")
+	etld1 = flag.Bool("etld1", false,
+		"reuse the decision of a registrable domain (eTLD+1) for its subdomains not seen before")
+	flagEtld1Exclude = flag.String("etld1-exclude", "",
+		"comma seperated list of domain names not to be aggregated by -etld1")
+	learnN = flag.Int("learn", 0,
+		"learn a suffix rule for a parent domain once this many distinct subdomains went to the same upstream\n"+
+			"\t0 to disable")
+	learnTTL = flag.Duration("learn-ttl", 24*time.Hour,
+		"TTL of learned suffix rules")
+	learnVerify = flag.Float64("learn-verify", 0.05,
+		"fraction of names served by learned rules to probe in background, dropping rules they contradict")
+	flagMixed = flag.String("mixed", "",
+		"per upstream policy for answers with both in-set and out-of-set A records, like \"A=reorder,B=require-all\"\n"+
+			"\tfilter: drop out-of-set ones (default), keep-all: keep them\n"+
+			"\trequire-all: don't match unless all in set, reorder: keep them but in-set ones first")
+	flagECS = flag.String("ecs", "",
+		"per upstream EDNS Client Subnet setting, like \"A=203.0.113.0/24,B=client,X=strip\"\n"+
+			"\ta fixed subnet, client: client's own subnet truncated to /24, strip: remove it from queries\n"+
+			"\tqueries are forwarded as is if omitted")
+	flagAcceptSpecial = flag.String("accept-special", "",
+		"per upstream special ranges accepted as in its IP set, like \"corp=10.0.0.0/8,corp=172.16.0.0/12\"\n"+
+			"\tfor corporate split DNS, internal names resolved by the VPN upstream")
+	flagStrict = flag.String("strict", "",
+		"what to do with A records from upstream X in another link's set\n"+
+			"\tstrip: remove them, requery: query the owning upstream instead, forwarded as is if omitted")
+	flagBind = flag.String("bind", "",
+		"per upstream source address, like \"A=192.168.1.2,X=10.0.0.2\"")
+	probePort = flag.Int("probe-connect", 0,
+		"TCP port to probe connectivity to addresses in no set, through X and each link with -bind\n"+
+			"\tthe faster link is saved as the decision, 0 to disable")
+	probeTimeout = flag.Duration("probe-timeout", time.Second,
+		"timeout of -probe-connect")
+	refreshInterval = flag.Duration("refresh", 0,
+		"interval to re-probe popular names in background, 0 to disable")
+	refreshAhead = flag.Duration("refresh-ahead", time.Hour,
+		"re-probe names whose decision expires within this, 0 to re-probe every interval regardless")
+	refreshMinHits = flag.Int("refresh-hits", 2,
+		"cache hits during an interval to be considered popular")
+	refreshMax = flag.Int("refresh-max", 100,
+		"maximum names re-probed per interval across all profiles, which also caps queries to each upstream")
+	flagProfiles = flag.String("profiles", "",
+		"file of per client profiles, picked by client subnet, see profile.go for the format")
+	flagTypeRoute = flag.String("type-route", "",
+		"send queries of a type straight to a named upstream, like \"TXT=X,MX=X,SOA=zone,mail.example.com/TXT=A\"\n"+
+			"\tzone: to the upstream of the closest enclosing name with a cached decision")
+	flagFailRcodes = flag.String("fail-rcodes", "SERVFAIL,REFUSED",
+		"comma seperated list of rcodes from upstreams treated as errors, the next address will be tried")
+	staleSize = flag.Int("stale", 0,
+		"keep the last good answers of this many names and types, to be served when all upstreams fail\n"+
+			"\t0 to disable")
+	staleTTL = flag.Duration("stale-ttl", 30*time.Second,
+		"TTL of stale answers")
+	staleMax = flag.Duration("stale-max", 24*time.Hour,
+		"stop serving an answer stale this long after it was saved, RFC 8767 suggests 1 to 3 days, 0 for no limit")
+	breakerFailures = flag.Int("breaker", 0,
+		"consecutive failures before an upstream address is considered down and skipped, 0 to disable")
+	breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second,
+		"interval to let one query through to an address considered down")
+	healthInterval = flag.Duration("health-interval", 0,
+		"interval to probe every upstream address actively, 0 to disable")
+	rttOrder = flag.Bool("rtt-order", false,
+		"try addresses of an upstream by smoothed RTT, instead of the order in command line")
+	rttExplore = flag.Float64("rtt-explore", 0.05,
+		"fraction of queries to try a random address first with -rtt-order")
+	failoverAfter = flag.Duration("failover-after", 0,
+		"serve names decided to an upstream through its fallback once all its addresses are down for this long\n"+
+			"\t0 to disable, requires -breaker, -health-interval is recommended to detect recovery")
+	flagFailover = flag.String("failover", "",
+		"per upstream fallback for -failover-after, like \"A=B,B=X\", X if omitted")
+	flagInflight = flag.String("inflight", "",
+		"per upstream limit of queries in flight, like \"A=16,X=32\"")
+	flagQPS = flag.String("qps", "",
+		"per upstream limit of queries per second, like \"A=50\", bursts of up to one second are allowed")
+	limitWait = flag.Duration("limit-wait", time.Second,
+		"how long a query over -inflight or -qps waits in queue before failing")
+	maxQueries = flag.Int("max-queries", 1024,
+		"client queries in flight beyond this are shed, 0 for no limit")
+	maxCacheWrites = flag.Int("max-cache-writes", 1024,
+		"pending decision cache writes beyond this are dropped, 0 for no limit")
+	flagShedRcode = flag.String("shed-rcode", "REFUSED",
+		"rcode to answer shed queries with, REFUSED or SERVFAIL")
+	resolvconfInterval = flag.Duration("resolvconf-interval", 5*time.Second,
+		"interval to check resolv.conf of resolvconf:/path upstreams for changes")
+	iterativePort = flag.Int("iterative-port", 53,
+		"port of name servers queried by iterative upstreams")
+	iterativeTimeout = flag.Duration("iterative-timeout", 5*time.Second,
+		"time limit to resolve a query by iterative upstreams, across all referrals")
+	flagAny = flag.String("any", "notimp",
+		"how to answer type ANY queries, RFC 8482\n"+
+			"\tnotimp: NOTIMP\n"+
+			"\thinfo: a synthesized HINFO record\n"+
+			"\tforward: diverge and forward, A records in the answer are held to the upstream's set")
+	backoff = flag.Duration("backoff", 0,
+		"answer a name from the best known upstream for this long after its probe failed, before probing again\n"+
+			"\t0 to disable")
 )
 
 var (
 	decisionCache cache
 	block         *domainSet
+	etld1Exclude  *domainSet
 	names         = []string{}
-	upstream      = [][]string{}
+	upstream      = []*upstreamGroup{}
 	ipFiles       = []string{}
-	ipMap         *ip4map.IP4Map
 	// dnsClient     = &dns.Client{}
 )
 
@@ -61,14 +161,40 @@ func main() {
 	}
 	fmt.Printf("configured with %d upstreams:\n", len(names))
 	for i, name := range names {
-		fmt.Printf("\t%s: %s\n", name, strings.Join(upstream[i], " "))
+		fmt.Printf("\t%s: %s\n", name, upstream[i])
 	}
 
+	parseMixedPolicy(*flagMixed)
+	parseECS(*flagECS)
+	parseAcceptSpecial(*flagAcceptSpecial)
+	parseStrict(*flagStrict)
+	parseBind(*flagBind)
+	parseFailover(*flagFailover)
+	parseLimits(*flagInflight, *flagQPS)
+	parseOverload(*maxQueries, *maxCacheWrites, *flagShedRcode)
+	parseTypeRoute(*flagTypeRoute)
+	parseFailRcodes(*flagFailRcodes)
+	parseAny(*flagAny)
+
 	decisionCache = newCache(*redisNetwork, *redisAddress, *redisIndex)
 	fmt.Println(decisionCache.info())
 
 	block = newDomainSet(*flagBlock)
-	ipMap = loadIPMap()
+	etld1Exclude = newDomainSet(*flagEtld1Exclude)
+	defaultProfile = newDefaultProfile()
+	if *flagProfiles != "" {
+		loadProfiles(*flagProfiles)
+	}
+
+	if *refreshInterval > 0 {
+		go refreshLoop()
+	}
+	if *healthInterval > 0 {
+		go healthLoop()
+	}
+	if hasResolvconf() {
+		go resolvconfLoop()
+	}
 
 	fmt.Printf("listen on %s\n", *listen)
 	// from the looks of the call stack, no need to wrap handler func in another go routine
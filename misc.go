@@ -33,18 +33,60 @@ var specialIPv4 = []string{
 	"255.255.255.255/32",
 }
 
-func parseUpstream(s string) []string {
+func parseUpstream(s string) *upstreamGroup {
+	if strings.HasPrefix(s, resolvconfPrefix) {
+		return newResolvconfGroup(s[len(resolvconfPrefix):])
+	}
+	if s == iterativePrefix || strings.HasPrefix(s, iterativePrefix+":") {
+		g := newUpstreamGroup([]string{})
+		g.iter = newIterResolver(strings.TrimPrefix(s[len(iterativePrefix):], ":"))
+		return g
+	}
 	u := strings.Split(s, ",")
 	for i, a := range u {
 		if !strings.ContainsAny(a, ":") {
 			u[i] = a + ":53"
 		}
 	}
-	return u
+	return newUpstreamGroup(u)
+}
+
+func parseFailRcodes(s string) {
+	for _, rc := range strings.Split(s, ",") {
+		if len(rc) == 0 {
+			continue
+		}
+		i, ok := dns.StringToRcode[strings.ToUpper(rc)]
+		if !ok {
+			log.Fatalf("invalid -fail-rcodes rcode: %s", rc)
+		}
+		failRcodes[i] = true
+	}
 }
 
-func loadIPMap() *ip4map.IP4Map {
-	lenSets := len(ipFiles)
+// parse per upstream options like "A=v1,B=v2,B=v3", keyed by decision
+func parsePerUpstream(flagName, s string) map[int][]string {
+	r := map[int][]string{}
+	for _, o := range strings.Split(s, ",") {
+		if len(o) == 0 {
+			continue
+		}
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid -%s option: %s", flagName, o)
+		}
+		dec := nameToDecision(kv[0])
+		if dec == noDecision {
+			log.Fatalf("invalid -%s option, no upstream named %s", flagName, kv[0])
+		}
+		r[dec] = append(r[dec], kv[1])
+	}
+	return r
+}
+
+// files are indexed like ipFiles, empty ones are skipped
+func loadIPMap(files []string) *ip4map.IP4Map {
+	lenSets := len(files)
 	var vBits int
 	switch {
 	case lenSets <= (1<<2)-3: // it's -3 instead of -2 since ipPrivate took another spot
@@ -58,8 +100,10 @@ func loadIPMap() *ip4map.IP4Map {
 	for _, s := range specialIPv4 {
 		newMap.SetStr(s, ipPrivate)
 	}
-	for i, fn := range ipFiles {
-		newMap.LoadFile(fn, ipA+i)
+	for i, fn := range files {
+		if fn != "" {
+			newMap.LoadFile(fn, ipA+i)
+		}
 	}
 	return newMap
 }
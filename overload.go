@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// global overload protection, client queries beyond -max-queries in flight are shed,
+// answered with -shed-rcode right away, and decision cache writes beyond -max-cache-writes pending are dropped
+
+var (
+	// nil if not limited
+	querySlots      chan struct{}
+	cacheWriteSlots chan struct{}
+	shedRcode       = dns.RcodeRefused
+)
+
+var (
+	queriesShed     = newCounter("queries-shed")
+	cacheWritesShed = newCounter("cache-writes-shed")
+)
+
+func parseOverload(maxQueries, maxCacheWrites int, rcode string) {
+	if maxQueries > 0 {
+		querySlots = make(chan struct{}, maxQueries)
+	}
+	if maxCacheWrites > 0 {
+		cacheWriteSlots = make(chan struct{}, maxCacheWrites)
+	}
+	switch strings.ToUpper(rcode) {
+	case "REFUSED":
+		shedRcode = dns.RcodeRefused
+	case "SERVFAIL":
+		shedRcode = dns.RcodeServerFailure
+	default:
+		log.Fatalf("invalid -shed-rcode: %s", rcode)
+	}
+}
+
+// false if the query should be shed, otherwise queryDone must be called
+func queryAdmit() bool {
+	if querySlots == nil {
+		return true
+	}
+	select {
+	case querySlots <- struct{}{}:
+		return true
+	default:
+		queriesShed.inc()
+		return false
+	}
+}
+
+func queryDone() {
+	if querySlots != nil {
+		<-querySlots
+	}
+}
+
+// set in background, unless too many are pending already
+func cacheWrite(c cache, k string, v int, ev evidence, ttl time.Duration) {
+	slots := cacheWriteSlots
+	if slots == nil {
+		go c.set(k, v, ev, ttl)
+		return
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		cacheWritesShed.inc()
+		log.Printf("\tcache write of %s dropped, too many pending", k)
+		return
+	}
+	go func() {
+		defer func() { <-slots }()
+		c.set(k, v, ev, ttl)
+	}()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// how postChk treats an A-side answer with a mix of in-set and out-of-set A records
+const (
+	// drop out-of-set A records, match if any left
+	policyFilter = iota
+	// keep all A records, match if any in set
+	policyKeepAll
+	// match only if all A records are in set
+	policyRequireAll
+	// keep all A records, in-set ones first, match if any in set
+	policyReorder
+)
+
+var policyNames = map[string]int{
+	"filter":      policyFilter,
+	"keep-all":    policyKeepAll,
+	"require-all": policyRequireAll,
+	"reorder":     policyReorder,
+}
+
+// keyed by decision, filter if omitted
+var mixedPolicy = map[int]int{}
+
+func parseMixedPolicy(s string) {
+	for dec, ps := range parsePerUpstream("mixed", s) {
+		if dec == upstreamX {
+			log.Fatalf("-mixed doesn't apply to %s, answers from it are not checked", decisionToStr(dec))
+		}
+		p, ok := policyNames[ps[len(ps)-1]]
+		if !ok {
+			log.Fatalf("invalid -mixed policy for %s: %s", decisionToStr(dec), ps[len(ps)-1])
+		}
+		mixedPolicy[dec] = p
+	}
+}
+
+func policyMatch(dec, nIn, nOut int) bool {
+	if mixedPolicy[dec] == policyRequireAll {
+		return nIn > 0 && nOut == 0
+	}
+	return nIn > 0
+}
+
+// keyed by decision, special ranges accepted as in set of that upstream, see -accept-special
+var acceptSpecial = map[int][]*net.IPNet{}
+
+func parseAcceptSpecial(s string) {
+	for dec, ns := range parsePerUpstream("accept-special", s) {
+		if dec == upstreamX {
+			log.Fatalf("-accept-special doesn't apply to %s, answers from it are not checked", decisionToStr(dec))
+		}
+		for _, n := range ns {
+			_, ipNet, err := net.ParseCIDR(n)
+			if err != nil {
+				log.Fatalf("invalid -accept-special range for %s: %s", decisionToStr(dec), n)
+			}
+			acceptSpecial[dec] = append(acceptSpecial[dec], ipNet)
+		}
+	}
+}
+
+// if ip is in set v, or a special address accepted by that upstream
+func inSet(p *profile, ip net.IP, v int) bool {
+	switch p.ipMap.GetIP(ip) {
+	case v:
+		return true
+	case ipPrivate:
+		for _, n := range acceptSpecial[upstreamA+v-ipA] {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// split A records by whether they're in set v
+func splitRR(p *profile, rrs []dns.RR, v int) (in, out []dns.RR) {
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			if inSet(p, a.A, v) {
+				in = append(in, rr)
+			} else {
+				out = append(out, rr)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// per upstream source address, see -bind, also used to probe connectivity through each link
+
+// keyed by decision
+var bindAddr = map[int]net.IP{}
+
+func parseBind(s string) {
+	for dec, as := range parsePerUpstream("bind", s) {
+		ip := net.ParseIP(as[len(as)-1])
+		if ip == nil {
+			log.Fatalf("invalid -bind address for %s: %s", decisionToStr(dec), as[len(as)-1])
+		}
+		bindAddr[dec] = ip
+	}
+}
+
+func newClient(dec int) *dns.Client {
+	client := &dns.Client{}
+	client.UDPSize = uint16(*UDPSize)
+	if ip, ok := bindAddr[dec]; ok {
+		client.Dialer = &net.Dialer{LocalAddr: &net.UDPAddr{IP: ip}}
+	}
+	return client
+}
+
+// connectivity probing, with -probe-connect, when the answer from X has no address in any set,
+// TCP connect latency to it is measured through X and each link with a source address,
+// the faster link is saved as the decision
+
+var (
+	probedConnect = newCounter("probed-connect")
+	probedFaster  = newCounter("probed-connect-faster")
+)
+
+// the first address in no set at all, nil if any address is in a set
+func unlistedAddr(p *profile, res *dns.Msg) net.IP {
+	var r net.IP
+	for _, ip := range answerIPs(res) {
+		if p.ipMap.GetIP(ip) != ipUnknown {
+			return nil
+		}
+		if r == nil {
+			r = ip
+		}
+	}
+	return r
+}
+
+func connectRTT(dec int, ip net.IP) (time.Duration, error) {
+	d := &net.Dialer{Timeout: *probeTimeout}
+	if src, ok := bindAddr[dec]; ok {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	start := time.Now()
+	conn, err := d.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(*probePort)))
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+func probeConnect(p *profile, req, res *dns.Msg, ip net.IP) {
+	probedConnect.inc()
+	name := req.Question[0].Name
+	decs := []int{upstreamX}
+	for _, i := range p.links {
+		if _, ok := bindAddr[i+upstreamA]; ok {
+			decs = append(decs, i+upstreamA)
+		}
+	}
+	best, bestRTT := noDecision, time.Duration(0)
+	for _, dec := range decs {
+		rtt, err := connectRTT(dec, ip)
+		if err != nil {
+			log.Printf("probe %s %v via %s: %v", name, ip, decisionToStr(dec), err)
+			continue
+		}
+		log.Printf("probe %s %v via %s: %v", name, ip, decisionToStr(dec), rtt)
+		if best == noDecision || rtt < bestRTT {
+			best, bestRTT = dec, rtt
+		}
+	}
+	if best == noDecision || best == upstreamX {
+		return
+	}
+	probedFaster.inc()
+	log.Printf("probe %s: %s is faster", name, decisionToStr(best))
+	// no evidence, since it can't be reclassified by IP sets
+	cacheSave(p, req, res, best, nil)
+}
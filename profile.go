@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"diverge/ip4map"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// per client policy profiles, picked by client subnet, from -profiles file, one per line like
+//	<name> <subnet>[,<subnet>...] [upstreams=<name>[,<name>...]] [ip.<name>=<file>] [block=<domain>[,<domain>...]] [ns=<namespace>]
+// upstreams: A-side upstreams to probe in order, X is always the last resort, so "upstreams=X" to always use X
+// ip.<name>: IP list of that upstream for this profile, defaults to the one in command line
+// block: defaults to -block
+// ns: decision cache namespace, defaults to the profile name
+// clients not in any profile use the default profile, which is what the command line configured
+
+type profile struct {
+	name string
+	nets []*net.IPNet
+	// A-side upstreams to probe in order, index to ipFiles
+	links   []int
+	ipFiles []string
+	ipMap   *ip4map.IP4Map
+	block   *domainSet
+	cache   cache
+	learn   *learner
+	hits    *hitCounter
+}
+
+var (
+	defaultProfile *profile
+	profiles       = []*profile{}
+)
+
+func newDefaultProfile() *profile {
+	links := make([]int, len(ipFiles))
+	for i := range links {
+		links[i] = i
+	}
+	p := &profile{
+		name:    "default",
+		links:   links,
+		ipFiles: ipFiles,
+		block:   block,
+		cache:   decisionCache,
+		learn:   newLearner(),
+		hits:    newHitCounter(),
+	}
+	p.ipMap = loadIPMap(p.ipFiles)
+	return p
+}
+
+func loadProfiles(fn string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		profiles = append(profiles, parseProfile(l))
+	}
+	if err := s.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func nameToDecision(name string) int {
+	for i, n := range names {
+		if n == name {
+			return i + upstreamX
+		}
+	}
+	return noDecision
+}
+
+func parseProfile(l string) *profile {
+	fields := strings.Fields(l)
+	if len(fields) < 2 {
+		log.Fatalf("invalid profile: %s", l)
+	}
+	p := &profile{
+		name:    fields[0],
+		links:   defaultProfile.links,
+		ipFiles: append([]string{}, ipFiles...),
+		block:   block,
+		learn:   newLearner(),
+		hits:    newHitCounter(),
+	}
+	for _, s := range strings.Split(fields[1], ",") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Fatalf("invalid subnet in profile %s: %s", p.name, s)
+		}
+		p.nets = append(p.nets, n)
+	}
+	ns := p.name
+	for _, o := range fields[2:] {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid option in profile %s: %s", p.name, o)
+		}
+		switch {
+		case kv[0] == "upstreams":
+			p.links = []int{}
+			for _, name := range strings.Split(kv[1], ",") {
+				dec := nameToDecision(name)
+				switch dec {
+				case noDecision:
+					log.Fatalf("invalid profile %s, no upstream named %s", p.name, name)
+				case upstreamX:
+				default:
+					p.links = append(p.links, dec-upstreamA)
+				}
+			}
+		case strings.HasPrefix(kv[0], "ip."):
+			dec := nameToDecision(kv[0][3:])
+			if dec == noDecision || dec == upstreamX {
+				log.Fatalf("invalid profile %s, no A-side upstream named %s", p.name, kv[0][3:])
+			}
+			p.ipFiles[dec-upstreamA] = kv[1]
+		case kv[0] == "block":
+			p.block = newDomainSet(kv[1])
+		case kv[0] == "ns":
+			ns = kv[1]
+		default:
+			log.Fatalf("invalid option in profile %s: %s", p.name, o)
+		}
+	}
+	p.cache = &nsCache{decisionCache, ns + "/"}
+	p.loadIPMap()
+	log.Printf("profile %s: %s", p.name, p.info())
+	return p
+}
+
+func (p *profile) info() string {
+	ls := []string{}
+	for _, i := range p.links {
+		ls = append(ls, decisionToStr(i+upstreamA))
+	}
+	ls = append(ls, decisionToStr(upstreamX))
+	return strings.Join(ls, ",")
+}
+
+// X, or one of the A-side upstreams probed
+func (p *profile) uses(dec int) bool {
+	if dec == upstreamX {
+		return true
+	}
+	for _, i := range p.links {
+		if i+upstreamA == dec {
+			return true
+		}
+	}
+	return false
+}
+
+// IP lists not used by this profile are not loaded,
+// and the map is shared with default profile if all lists are used and the same
+func (p *profile) loadIPMap() {
+	files := make([]string, len(p.ipFiles))
+	same := len(p.links) == len(ipFiles)
+	for _, i := range p.links {
+		files[i] = p.ipFiles[i]
+		if files[i] != ipFiles[i] {
+			same = false
+		}
+	}
+	if same && p != defaultProfile {
+		p.ipMap = defaultProfile.ipMap
+		return
+	}
+	p.ipMap = loadIPMap(files)
+}
+
+func reloadIPMaps() {
+	defaultProfile.ipMap = loadIPMap(defaultProfile.ipFiles)
+	for _, p := range profiles {
+		p.loadIPMap()
+	}
+}
+
+func profileOf(w dns.ResponseWriter) *profile {
+	if ip := clientIP(w); ip != nil {
+		for _, p := range profiles {
+			for _, n := range p.nets {
+				if n.Contains(ip) {
+					return p
+				}
+			}
+		}
+	}
+	return defaultProfile
+}
+
+// decision cache with keys prefixed, for profile namespaces
+type nsCache struct {
+	cache
+	prefix string
+}
+
+func (nc *nsCache) set(k string, v int, ev evidence, ttl time.Duration) {
+	nc.cache.set(nc.prefix+k, v, ev, ttl)
+}
+
+func (nc *nsCache) get(k string) int {
+	return nc.cache.get(nc.prefix + k)
+}
+
+func (nc *nsCache) update(k string, v int, ev evidence) {
+	nc.cache.update(nc.prefix+k, v, ev)
+}
+
+func (nc *nsCache) del(k string) {
+	nc.cache.del(nc.prefix + k)
+}
+
+func (nc *nsCache) ttl(k string) time.Duration {
+	return nc.cache.ttl(nc.prefix + k)
+}
+
+func (nc *nsCache) scan(f func(k string, v int, ev evidence)) {
+	nc.cache.scan(func(k string, v int, ev evidence) {
+		if strings.HasPrefix(k, nc.prefix) {
+			f(k[len(nc.prefix):], v, ev)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// background re-validation, every -refresh interval popular names (by cache hits during the interval)
+// are probed again if their entries are about to expire, the cache is updated if the outcome changes
+
+// one per profile
+type hitCounter struct {
+	sync.Mutex
+	m map[string]int
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{m: map[string]int{}}
+}
+
+var (
+	refreshed        = newCounter("refreshed")
+	refreshedChanged = newCounter("refreshed-changed")
+)
+
+func (hc *hitCounter) hit(name string) {
+	if *refreshInterval <= 0 {
+		return
+	}
+	hc.Lock()
+	defer hc.Unlock()
+	hc.m[name]++
+}
+
+func refreshLoop() {
+	round := 0
+	for range time.Tick(*refreshInterval) {
+		// -refresh-max is shared by all profiles, which take turns to go first
+		budget := *refreshMax
+		all := append([]*profile{defaultProfile}, profiles...)
+		for i := range all {
+			refreshRound(all[(round+i)%len(all)], &budget)
+		}
+		round++
+	}
+}
+
+// refresh at most budget names, which is decreased by the names refreshed
+func refreshRound(p *profile, budget *int) {
+	p.hits.Lock()
+	hits := p.hits.m
+	p.hits.m = map[string]int{}
+	p.hits.Unlock()
+
+	popular := make([]string, 0, len(hits))
+	for name, n := range hits {
+		if n >= *refreshMinHits {
+			popular = append(popular, name)
+		}
+	}
+	sort.Slice(popular, func(i, j int) bool {
+		return hits[popular[i]] > hits[popular[j]]
+	})
+	// every probe sends at most one query to each upstream,
+	// so this caps refresh queries per upstream too
+	for i, name := range popular {
+		if *budget <= 0 {
+			log.Printf("refresh %s: limit reached, %d names skipped", p.name, len(popular)-i)
+			break
+		}
+		// negative TTL means it never expires, refresh it on schedule
+		if ttl := p.cache.ttl(name); *refreshAhead > 0 && ttl >= *refreshAhead {
+			continue
+		}
+		*budget--
+		refreshName(p, name)
+	}
+}
+
+func refreshName(p *profile, name string) {
+	refreshed.inc()
+	old := p.cache.get(name)
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	dec := handleDivergeTypeA(p, nil, req)
+	if dec != noDecision && dec != old {
+		refreshedChanged.inc()
+		log.Printf("refresh %s: %s -> %s", name, decisionToStr(old), decisionToStr(dec))
+	}
+}
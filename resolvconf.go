@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// addresses of an upstream, fixed in command line, or read from a resolv.conf like
+//	resolvconf:/run/link-a/resolv.conf
+// which is polled every -resolvconf-interval, and swapped atomically when it changes, like on DHCP renewal
+
+const resolvconfPrefix = "resolvconf:"
+
+type upstreamGroup struct {
+	// []string
+	addrs atomic.Value
+	// "" if fixed
+	resolvconf string
+	// not nil if resolving iteratively, without addresses
+	iter *iterResolver
+	// only touched by resolvconfLoop after startup
+	mtime time.Time
+}
+
+func newUpstreamGroup(addrs []string) *upstreamGroup {
+	g := &upstreamGroup{}
+	g.addrs.Store(addrs)
+	return g
+}
+
+func (g *upstreamGroup) get() []string {
+	return g.addrs.Load().([]string)
+}
+
+func (g *upstreamGroup) String() string {
+	s := strings.Join(g.get(), " ")
+	if g.resolvconf != "" {
+		s += " from " + g.resolvconf
+	}
+	if g.iter != nil {
+		s = "iterative from " + strings.Join(g.iter.roots, " ")
+	}
+	return s
+}
+
+func readResolvconf(fn string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(conf.Servers))
+	for _, s := range conf.Servers {
+		addrs = append(addrs, net.JoinHostPort(s, conf.Port))
+	}
+	return addrs, nil
+}
+
+// reload if modified, true if the addresses changed
+func (g *upstreamGroup) reload() bool {
+	fi, err := os.Stat(g.resolvconf)
+	if err != nil {
+		log.Printf("resolvconf %s: %v", g.resolvconf, err)
+		return false
+	}
+	if fi.ModTime().Equal(g.mtime) {
+		return false
+	}
+	addrs, err := readResolvconf(g.resolvconf)
+	if err != nil {
+		// maybe half written, try again next time
+		log.Printf("resolvconf %s: %v", g.resolvconf, err)
+		return false
+	}
+	g.mtime = fi.ModTime()
+	old := g.get()
+	if strings.Join(old, " ") == strings.Join(addrs, " ") {
+		return false
+	}
+	g.addrs.Store(addrs)
+	log.Printf("resolvconf %s: %s -> %s", g.resolvconf, strings.Join(old, " "), strings.Join(addrs, " "))
+	return true
+}
+
+func newResolvconfGroup(fn string) *upstreamGroup {
+	g := newUpstreamGroup([]string{})
+	g.resolvconf = fn
+	// the link may not be up yet, so not fatal
+	g.reload()
+	return g
+}
+
+func resolvconfLoop() {
+	for range time.Tick(*resolvconfInterval) {
+		for i, g := range upstream {
+			if g.resolvconf != "" && g.reload() {
+				log.Printf("upstream %s: %s", decisionToStr(i+upstreamX), g)
+			}
+		}
+	}
+}
+
+func hasResolvconf() bool {
+	for _, g := range upstream {
+		if g.resolvconf != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func processSignal() {
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 loop:
 	for {
@@ -19,7 +19,8 @@ loop:
 			break loop
 		case syscall.SIGUSR1:
 			log.Printf("signal %v, reloading IP list files\n", s)
-			ipMap = loadIPMap()
+			reloadIPMaps()
+			reclassifyCache()
 		}
 	}
 }
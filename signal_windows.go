@@ -8,7 +8,7 @@ import (
 )
 
 func processSignal() {
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 loop:
 	for {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serve-stale, RFC 8767, with -stale N the last good answer from each upstream of N most recent names and types
+// are kept, to be served with a short TTL when live resolution fails, for up to -stale-max
+// and to clients of profiles using that upstream only
+
+type staleKey struct {
+	name  string
+	qtype uint16
+}
+
+type staleEntry struct {
+	key staleKey
+	// indexed like upstream
+	answers []*dns.Msg
+	saved   []time.Time
+}
+
+var staleStore = struct {
+	sync.Mutex
+	l *list.List
+	m map[staleKey]*list.Element
+}{
+	l: list.New(),
+	m: map[staleKey]*list.Element{},
+}
+
+var staleServed = newCounter("stale-served")
+
+func staleKeyOf(req *dns.Msg) staleKey {
+	q := &req.Question[0]
+	return staleKey{dns.CanonicalName(q.Name), q.Qtype}
+}
+
+func staleSave(req, res *dns.Msg, dec int) {
+	if *staleSize <= 0 || res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return
+	}
+	k := staleKeyOf(req)
+	res = res.Copy()
+	staleStore.Lock()
+	defer staleStore.Unlock()
+	var e *staleEntry
+	if le, in := staleStore.m[k]; in {
+		staleStore.l.MoveToFront(le)
+		e = le.Value.(*staleEntry)
+	} else {
+		e = &staleEntry{k, make([]*dns.Msg, len(upstream)), make([]time.Time, len(upstream))}
+		staleStore.m[k] = staleStore.l.PushFront(e)
+		if staleStore.l.Len() > *staleSize {
+			oldest := staleStore.l.Remove(staleStore.l.Back()).(*staleEntry)
+			delete(staleStore.m, oldest.key)
+		}
+	}
+	e.answers[dec-upstreamX] = res
+	e.saved[dec-upstreamX] = time.Now()
+}
+
+// the answer from upstream dec, or the most recent one if dec is noDecision or not available,
+// only from upstreams profile p uses, and not older than -stale-max
+func staleGet(p *profile, req *dns.Msg, dec int) *dns.Msg {
+	staleStore.Lock()
+	defer staleStore.Unlock()
+	le, in := staleStore.m[staleKeyOf(req)]
+	if !in {
+		return nil
+	}
+	e := le.Value.(*staleEntry)
+	usable := func(i int) bool {
+		return e.answers[i] != nil && p.uses(i+upstreamX) && (*staleMax <= 0 || time.Since(e.saved[i]) <= *staleMax)
+	}
+	if dec != noDecision && usable(dec-upstreamX) {
+		return e.answers[dec-upstreamX].Copy()
+	}
+	last := -1
+	for i := range e.answers {
+		if usable(i) && (last == -1 || e.saved[i].After(e.saved[last])) {
+			last = i
+		}
+	}
+	if last == -1 {
+		return nil
+	}
+	return e.answers[last].Copy()
+}
+
+// serve a stale answer, false if there's none
+func handleStale(p *profile, w dns.ResponseWriter, req *dns.Msg, dec int) bool {
+	if *staleSize <= 0 {
+		return false
+	}
+	res := staleGet(p, req, dec)
+	if res == nil {
+		return false
+	}
+	res.Id = req.Id
+	res.Question = req.Question
+	// OPT and ECS echo of this client's own, not the one the answer was saved for
+	fixECSReply(req, res)
+	ttl := uint32(*staleTTL / rrTTLUnit)
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	// Extended DNS Error, RFC 8914, only if client speaks EDNS
+	if req.IsEdns0() != nil {
+		opt := res.IsEdns0()
+		if opt == nil {
+			res.SetEdns0(ednsUDPSize, false)
+			opt = res.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	staleServed.inc()
+	log.Printf("\tserve stale %s: %s", req.Question[0].Name, decisionToStr(dec))
+	w.WriteMsg(res)
+	return true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// simple counters, exposed via CHAOS "stats.diverge."
+
+type counter struct {
+	// keep n first, 64 bit atomic operations need it aligned on 32 bit platforms
+	n    int64
+	name string
+}
+
+var counters = []*counter{}
+
+func newCounter(name string) *counter {
+	c := &counter{name: name}
+	counters = append(counters, c)
+	return c
+}
+
+func (c *counter) inc() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func (c *counter) get() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+func statsInfo() []string {
+	r := make([]string, 0, len(counters))
+	for _, c := range counters {
+		r = append(r, c.name+": "+strconv.FormatInt(c.get(), 10))
+	}
+	return r
+}
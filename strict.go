@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// strict mode for answers from upstream X, which are otherwise forwarded unfiltered,
+// A records in another link's set (a CDN geolocating X's resolver) are stripped,
+// or the owning upstream is queried instead
+
+const (
+	strictOff = iota
+	strictStrip
+	strictRequery
+)
+
+var strictModes = map[string]int{
+	"":        strictOff,
+	"strip":   strictStrip,
+	"requery": strictRequery,
+}
+
+var strictMode int
+
+var (
+	strictStripped  = newCounter("strict-stripped")
+	strictRequeried = newCounter("strict-requeried")
+)
+
+func parseStrict(s string) {
+	m, ok := strictModes[s]
+	if !ok {
+		log.Fatalf("invalid -strict mode: %s", s)
+	}
+	strictMode = m
+}
+
+// check an answer from upstream X, returns the answer to use and the upstream it's from,
+// a stripped answer is a copy, res is left as X answered
+func strictX(p *profile, w dns.ResponseWriter, req, res *dns.Msg) (*dns.Msg, int) {
+	if strictMode == strictOff {
+		return res, upstreamX
+	}
+	name := req.Question[0].Name
+	owner := ipUnknown
+	answer := make([]dns.RR, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			// only upstreams of the profile, the others are not for its clients
+			if v := p.ipMap.GetIP(a.A); v >= ipA && p.uses(upstreamA+v-ipA) {
+				log.Printf("\tstrict %s: %s answered %v which is in %s", name, decisionToStr(upstreamX), a.A, ipValueToStr(v))
+				if owner == ipUnknown {
+					owner = v
+				}
+				continue
+			}
+		}
+		answer = append(answer, rr)
+	}
+	if owner == ipUnknown {
+		return res, upstreamX
+	}
+	if strictMode == strictRequery {
+		dec := upstreamA + owner - ipA
+		r, _, err := exchangeECS(req, dec, clientIP(w))
+		if err != nil {
+			log.Printf("\tstrict %s: upstream %s error: %v", name, decisionToStr(dec), err)
+		} else if postChk(p, r, owner) {
+			strictRequeried.inc()
+			log.Printf("\tstrict %s: answered by %s instead", name, decisionToStr(dec))
+			return r, dec
+		}
+	}
+	strictStripped.inc()
+	res = res.Copy()
+	res.Answer = answer
+	return res, upstreamX
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// query type routing, -type-route like "TXT=X,MX=X,SOA=zone,mail.example.com/TXT=A"
+// sends queries of a type, optionally under a suffix, straight to a named upstream, bypassing the probe,
+// or "zone" to the upstream of the closest enclosing name with a cached decision
+
+const routeZone = -1
+
+// keyed by type, then suffix, "." for rules without suffix
+var typeRoutes = map[uint16]map[string]int{}
+
+func parseTypeRoute(s string) {
+	for _, r := range strings.Split(s, ",") {
+		if len(r) == 0 {
+			continue
+		}
+		kv := strings.SplitN(r, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid -type-route rule: %s", r)
+		}
+		suffix := "."
+		t := kv[0]
+		if slash := strings.LastIndexByte(t, '/'); slash != -1 {
+			suffix = dns.Fqdn(strings.ToLower(t[:slash]))
+			t = t[slash+1:]
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			log.Fatalf("invalid -type-route rule, unknown type: %s", r)
+		}
+		dec := routeZone
+		if kv[1] != "zone" {
+			if dec = nameToDecision(kv[1]); dec == noDecision {
+				log.Fatalf("invalid -type-route rule, no upstream named %s", kv[1])
+			}
+		}
+		if typeRoutes[qtype] == nil {
+			typeRoutes[qtype] = map[string]int{}
+		}
+		typeRoutes[qtype][suffix] = dec
+	}
+}
+
+// the longest matching suffix wins
+func typeRouteOf(qtype uint16, name string) (int, bool) {
+	rules := typeRoutes[qtype]
+	if rules == nil {
+		return noDecision, false
+	}
+	for n, ok := strings.ToLower(name), true; ok; n, ok = parentDomain(n) {
+		if dec, in := rules[n]; in {
+			return dec, true
+		}
+	}
+	dec, in := rules["."]
+	return dec, in
+}
+
+// noDecision if it should be probed as usual
+func typeRoute(p *profile, q *dns.Question) (int, bool) {
+	dec, ok := typeRouteOf(q.Qtype, q.Name)
+	if !ok {
+		return noDecision, false
+	}
+	if dec == routeZone {
+		dec = noDecision
+		for n, ok := q.Name, true; ok; n, ok = parentDomain(n) {
+			if dec = p.cache.get(n); dec != noDecision {
+				log.Printf("\ttype route %s %s: %s, from %s", q.Name, dns.TypeToString[q.Qtype], decisionToStr(dec), n)
+				break
+			}
+		}
+		return dec, true
+	}
+	if !p.uses(dec) {
+		// the profile doesn't go through that link, so probed within the profile's links
+		log.Printf("\ttype route %s %s: %s, not used by profile %s", q.Name, dns.TypeToString[q.Qtype], decisionToStr(dec), p.name)
+		return noDecision, false
+	}
+	log.Printf("\ttype route %s %s: %s", q.Name, dns.TypeToString[q.Qtype], decisionToStr(dec))
+	return dec, true
+}